@@ -0,0 +1,358 @@
+package appx
+
+import (
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/laydong/toolpkg"
+	"github.com/laydong/toolpkg/alarmx"
+	"github.com/laydong/toolpkg/confx"
+	"github.com/laydong/toolpkg/db"
+	"github.com/laydong/toolpkg/grpcx"
+	"github.com/laydong/toolpkg/httpx"
+	"github.com/laydong/toolpkg/logx"
+	"github.com/laydong/toolpkg/tracex"
+	"gorm.io/gorm"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultShutdownTimeout = 10 * time.Second // 等待服务优雅退出的最长时间
+)
+
+// Config app 统一配置, 在 toolpkg.AppConf 的基础上扩展了各组件的配置
+type Config struct {
+	toolpkg.AppConf
+	RunMode   string      `json:"run_mode"`   // gin运行模式 debug/release/test
+	TraceType string      `json:"trace_type"` // 链路记录类型 zipkin 和 jaeger
+	TraceAddr string      `json:"trace_addr"` // 链路上报地址
+	TraceMod  float64     `json:"trace_mod"`  // 链路采样率
+	HttpAddr  string      `json:"http_addr"`  // http服务监听地址, 为空不启动
+	GrpcAddr  string      `json:"grpc_addr"`  // grpc服务监听地址, 为空不启动
+	Mysql     MysqlConf   `json:"mysql"`      // mysql配置, dsn为空不初始化
+	Databases []db.DbConf `json:"databases"`  // 其他mysql实例, 通过 db.GetDB(ctx, name) 使用
+	Redis     RedisConf   `json:"redis"`      // redis配置, addr和addrs为空不初始化
+	Ding      DingConf    `json:"ding"`       // 钉钉告警配置, key为空不初始化
+
+	SqlMask     []logx.MaskRule `json:"sql_mask"`     // sql日志和审计日志的脱敏规则
+	QueryBudget db.QueryBudget  `json:"query_budget"` // 每个请求的查询次数和耗时预算
+
+	NoLogParams       []string `json:"no_log_params"`        // 不打印出入参的路由
+	NoLogParamsPrefix []string `json:"no_log_params_prefix"` // 不打印出入参的路由前缀
+	NoLogParamsSuffix []string `json:"no_log_params_suffix"` // 不打印出入参的路由后缀
+}
+
+// MysqlConf mysql配置, 默认实例, name固定为 default
+type MysqlConf struct {
+	db.DbConf
+}
+
+// RedisConf redis配置, 支持单节点、哨兵和集群, 见 db.RdbConf
+type RedisConf struct {
+	db.RdbConf
+	Addr string `json:"addr"` // 单节点地址, 兼容旧配置, 和 addrs 同时设置时放在最前面
+}
+
+// rdbConf 合并 addr 到 addrs
+func (c RedisConf) rdbConf() db.RdbConf {
+	conf := c.RdbConf
+	if c.Addr != "" {
+		conf.Addrs = append([]string{c.Addr}, conf.Addrs...)
+	}
+	return conf
+}
+
+// DingConf 钉钉告警配置
+type DingConf struct {
+	Key  string `json:"key"`
+	Host string `json:"host"`
+}
+
+// Validate 校验 confx 的 validate tag 无法表达的必填项, mysql 和 databases 中的实例共用 db.DbConf, 只有 databases 要求必填
+func (conf *Config) Validate() error {
+	names := make(map[string]bool, len(conf.Databases))
+	for i, dc := range conf.Databases {
+		switch {
+		case dc.Name == "":
+			return fmt.Errorf("databases[%d].name is required", i)
+		case dc.Dsn == "":
+			return fmt.Errorf("databases[%d].dsn is required", i)
+		case dc.Name == db.DefaultDBName:
+			return fmt.Errorf("databases[%d].name %s is reserved for mysql", i, dc.Name)
+		case names[dc.Name]:
+			return fmt.Errorf("databases[%d].name %s is duplicated", i, dc.Name)
+		}
+		names[dc.Name] = true
+	}
+	return nil
+}
+
+func (conf *Config) fillDefaults() {
+	if conf.RunMode == "" {
+		conf.RunMode = logx.DefaultRunMode
+	}
+	if conf.AppName == "" {
+		conf.AppName = logx.DefaultAppName
+	}
+	if conf.TraceType == "" {
+		conf.TraceType = logx.DefaultTraceType
+	}
+}
+
+// App 应用, 按依赖顺序初始化各个组件, 退出时按相反的顺序关闭
+type App struct {
+	confLock sync.RWMutex
+	conf     Config
+
+	db   *gorm.DB
+	rdb  redis.UniversalClient
+	web  *httpx.WebServer
+	grpc *grpcx.GrpcServer
+
+	closers []func() error
+}
+
+// NewApp 按 日志 -> 链路 -> 告警 -> mysql -> redis -> 服务 的顺序初始化应用
+// 任意组件初始化失败都会关闭已经初始化的组件并返回错误
+func NewApp(conf Config) (app *App, err error) {
+	conf.fillDefaults()
+	app = &App{conf: conf}
+	defer func() {
+		if err != nil {
+			_ = app.Close()
+		}
+	}()
+
+	toolpkg.InitLog(conf.AppConf)
+	app.onClose(func() error {
+		_ = logx.Sugar.Sync()
+		return nil
+	})
+
+	if err = logx.SetSqlMask(conf.SqlMask...); err != nil {
+		return
+	}
+	db.SetQueryBudget(conf.QueryBudget)
+
+	// tracer 关闭后按 logx 中的默认配置重建, 保持与应用配置一致
+	logx.DefaultTraceType, logx.DefaultTraceAddr, logx.DefaultTraceMod = conf.TraceType, conf.TraceAddr, conf.TraceMod
+	tracex.InitTrace(conf.AppName, conf.TraceType, conf.TraceAddr, conf.TraceMod)
+	app.onClose(tracex.CloseTrace)
+
+	if conf.Ding.Key != "" {
+		alarmx.InitDing(conf.Ding.Key, conf.Ding.Host)
+	}
+
+	if conf.Mysql.Dsn != "" {
+		mc := conf.Mysql.DbConf
+		mc.Name = db.DefaultDBName
+		app.db, err = db.RegisterDB(mc)
+		if err != nil {
+			return
+		}
+		app.onClose(func() error {
+			return db.CloseDB(db.DefaultDBName)
+		})
+	}
+	for _, dc := range conf.Databases {
+		if _, err = db.RegisterDB(dc); err != nil {
+			return
+		}
+		name := dc.Name
+		app.onClose(func() error {
+			return db.CloseDB(name)
+		})
+	}
+
+	if conf.Redis.Addr != "" || len(conf.Redis.Addrs) > 0 {
+		app.rdb, err = db.NewRdb(conf.Redis.rdbConf())
+		if app.rdb != nil {
+			app.onClose(app.rdb.Close)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	if conf.HttpAddr != "" {
+		httpx.SetNoLogParams(conf.NoLogParams, conf.NoLogParamsPrefix, conf.NoLogParamsSuffix)
+		app.web = httpx.NewWebServer(conf.RunMode)
+		app.web.Use(httpx.DefaultWebServerMiddlewares...)
+	}
+
+	if conf.GrpcAddr != "" {
+		app.grpc = grpcx.NewGrpcServer()
+		app.onClose(func() error {
+			app.grpc.Stop()
+			return nil
+		})
+	}
+	return
+}
+
+// NewAppFromFile 从配置文件加载配置后初始化应用, 加载规则见 confx.Load
+func NewAppFromFile(path string, opts ...confx.OptionFunc) (*App, error) {
+	var conf Config
+	if err := confx.Load(path, &conf, opts...); err != nil {
+		return nil, err
+	}
+	return NewApp(conf)
+}
+
+// Config 获取应用配置
+func (app *App) Config() Config {
+	app.confLock.RLock()
+	defer app.confLock.RUnlock()
+	return app.conf
+}
+
+// WatchConfig 监听配置文件变更, 热更新日志级别和轮转规则、sql脱敏规则、查询预算、链路采样率、不打印出入参的路由
+// 其他字段的变更需要重启才能生效, 返回的 Watcher 可以继续注册业务自己的订阅者
+func (app *App) WatchConfig(path string, opts ...confx.OptionFunc) (*confx.Watcher, error) {
+	var conf Config
+	w, err := confx.NewWatcher(path, &conf, opts...)
+	if err != nil {
+		return nil, err
+	}
+	w.Subscribe(app.onConfigChange)
+	app.onClose(w.Close)
+	return w, nil
+}
+
+// onConfigChange 应用可以热更新的配置, 失败时撤销已应用的部分并拒绝本次变更
+func (app *App) onConfigChange(old, new interface{}) (err error) {
+	o, n := old.(*Config), new.(*Config)
+
+	if n.TraceMod != o.TraceMod {
+		if err = tracex.SetSampleRate(n.TraceMod); err != nil {
+			return
+		}
+		logx.DefaultTraceMod = n.TraceMod
+		defer func() {
+			if err != nil {
+				_ = tracex.SetSampleRate(o.TraceMod)
+				logx.DefaultTraceMod = o.TraceMod
+			}
+		}()
+	}
+
+	if n.LogLevel != o.LogLevel {
+		level := logx.GetLevel()
+		if err = logx.SetLevel(n.LogLevel); err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				_ = logx.SetLevel(level)
+			}
+		}()
+	}
+
+	if !reflect.DeepEqual(n.SqlMask, o.SqlMask) {
+		if err = logx.SetSqlMask(n.SqlMask...); err != nil {
+			return
+		}
+	}
+
+	if n.QueryBudget != o.QueryBudget {
+		db.SetQueryBudget(n.QueryBudget)
+	}
+
+	oa, na := o.AppConf, n.AppConf
+	oa.LogLevel, na.LogLevel = "", ""
+	if oa != na {
+		toolpkg.InitLog(n.AppConf)
+	}
+
+	if !reflect.DeepEqual(n.NoLogParams, o.NoLogParams) ||
+		!reflect.DeepEqual(n.NoLogParamsPrefix, o.NoLogParamsPrefix) ||
+		!reflect.DeepEqual(n.NoLogParamsSuffix, o.NoLogParamsSuffix) {
+		httpx.SetNoLogParams(n.NoLogParams, n.NoLogParamsPrefix, n.NoLogParamsSuffix)
+	}
+
+	conf := *n
+	conf.fillDefaults()
+	app.confLock.Lock()
+	app.conf = conf
+	app.confLock.Unlock()
+	return
+}
+
+// DB 获取mysql, 未配置时返回nil
+func (app *App) DB() *gorm.DB {
+	return app.db
+}
+
+// Redis 获取redis, 未配置时返回nil, 单节点和哨兵为 *redis.Client, 集群为 *redis.ClusterClient
+func (app *App) Redis() redis.UniversalClient {
+	return app.rdb
+}
+
+// WebServer 获取http服务, 未配置http_addr时返回nil
+func (app *App) WebServer() *httpx.WebServer {
+	return app.web
+}
+
+// GrpcServer 获取grpc服务, 未配置grpc_addr时返回nil
+func (app *App) GrpcServer() *grpcx.GrpcServer {
+	return app.grpc
+}
+
+// Run 启动已配置的服务并阻塞, 收到退出信号或服务异常退出后关闭应用
+func (app *App) Run() (err error) {
+	webCh := make(chan error, 1)
+	grpcCh := make(chan error, 1)
+	if app.web != nil {
+		go func() {
+			webCh <- app.web.RunGrace(app.conf.HttpAddr)
+		}()
+	}
+	if app.grpc != nil {
+		go func() {
+			grpcCh <- app.grpc.Run(app.conf.GrpcAddr)
+		}()
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(quit)
+
+	select {
+	case sig := <-quit:
+		log.Printf("[app] receive signal %s, shutting down", sig)
+		// http服务收到同样的信号后会自行优雅退出, 这里等待它处理完
+		if app.web != nil {
+			select {
+			case err = <-webCh:
+			case <-time.After(defaultShutdownTimeout):
+			}
+		}
+	case err = <-webCh:
+	case err = <-grpcCh:
+	}
+
+	if cerr := app.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+// Close 按初始化相反的顺序关闭各个组件, 返回第一个错误
+func (app *App) Close() (err error) {
+	for i := len(app.closers) - 1; i >= 0; i-- {
+		if cerr := app.closers[i](); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	app.closers = nil
+	return
+}
+
+func (app *App) onClose(f func() error) {
+	app.closers = append(app.closers, f)
+}
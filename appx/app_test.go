@@ -0,0 +1,64 @@
+package appx
+
+import (
+	"github.com/laydong/toolpkg/confx"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			data: map[string]interface{}{
+				"app_name":  "demo",
+				"mysql":     map[string]interface{}{"dsn": "root@tcp(127.0.0.1:3306)/demo"},
+				"databases": []interface{}{map[string]interface{}{"name": "order", "dsn": "root@tcp(127.0.0.1:3306)/order"}},
+			},
+		},
+		{
+			name:    "missing app_name",
+			data:    map[string]interface{}{"http_addr": ":8080"},
+			wantErr: true,
+		},
+		{
+			name: "database without name",
+			data: map[string]interface{}{
+				"app_name":  "demo",
+				"databases": []interface{}{map[string]interface{}{"dsn": "root@tcp(127.0.0.1:3306)/order"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "database without dsn",
+			data: map[string]interface{}{
+				"app_name":  "demo",
+				"databases": []interface{}{map[string]interface{}{"name": "order"}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "duplicated database",
+			data: map[string]interface{}{
+				"app_name": "demo",
+				"databases": []interface{}{
+					map[string]interface{}{"name": "order", "dsn": "a"},
+					map[string]interface{}{"name": "order", "dsn": "b"},
+				},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf Config
+			err := confx.Decode(tt.data, &conf)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Decode() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
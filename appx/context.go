@@ -1,6 +1,7 @@
 package appx
 
 import (
+	"context"
 	"github.com/laydong/toolpkg/alarmx"
 	"github.com/laydong/toolpkg/datax"
 	"github.com/laydong/toolpkg/logx"
@@ -11,41 +12,100 @@ import (
 )
 
 // Context is the carrier of request and response
+// Context 包装了一个真实的 context.Context, 超时和取消都来自它
 type Context struct {
+	parent context.Context
+
 	*datax.MemoryContext
 	*logx.LogContext
 	*tracex.TraceContext
 	*alarmx.AlarmContext
 }
 
+var _ context.Context = &Context{}
+
 // NewDefaultContext 创建 app 默认的context, spanName
 func NewDefaultContext(logId string, spanName string) *Context {
+	return NewContext(context.Background(), logId, spanName)
+}
+
+// NewContext 基于parent创建 app context, parent的超时、取消和值都会被继承
+func NewContext(parent context.Context, logId string, spanName string) *Context {
+	if parent == nil {
+		parent = context.Background()
+	}
 	if logId == "" {
 		logId = utils.Md5(uuid.NewV4().String())
 	}
 
 	tmp := &Context{
+		parent:        parent,
 		LogContext:    logx.NewLogContext(logId),
 		TraceContext:  tracex.NewTraceContext(spanName, make(map[string][]string)),
 		MemoryContext: datax.NewMemoryContext(),
 	}
+	tmp.Set(utils.RequestIdKey, logId)
+	tmp.Set(tracex.TraceContextKey, tmp.TraceContext)
 
 	return tmp
 }
 
+// WithCancel 派生一个可以取消的context, 日志、链路和数据与当前context共享
+func (c *Context) WithCancel() (*Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.getParent())
+	return c.withParent(ctx), cancel
+}
+
+// WithTimeout 派生一个带超时的context, 日志、链路和数据与当前context共享
+func (c *Context) WithTimeout(timeout time.Duration) (*Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(c.getParent(), timeout)
+	return c.withParent(ctx), cancel
+}
+
+// WithDeadline 派生一个带截止时间的context, 日志、链路和数据与当前context共享
+func (c *Context) WithDeadline(d time.Time) (*Context, context.CancelFunc) {
+	ctx, cancel := context.WithDeadline(c.getParent(), d)
+	return c.withParent(ctx), cancel
+}
+
+// WithScope 派生一个使用子数据作用域的context, 可以读到当前context的数据, 写入不会影响当前context
+// 适合传给goroutine使用
+func (c *Context) WithScope() *Context {
+	tmp := *c
+	tmp.MemoryContext = c.MemoryContext.NewScope()
+	return &tmp
+}
+
+func (c *Context) withParent(parent context.Context) *Context {
+	tmp := *c
+	tmp.parent = parent
+	return &tmp
+}
+
+func (c *Context) getParent() context.Context {
+	if c.parent == nil {
+		return context.Background()
+	}
+	return c.parent
+}
+
+// Finish 结束顶层span
+func (c *Context) Finish() {
+	c.SpanFinish(c.TopSpan)
+}
+
 // Deadline returns the time when work done on behalf of this contextx
 // should be canceled. Deadline returns ok==false when no deadline is
 // set. Successive calls to Deadline return the same results.
 func (c *Context) Deadline() (deadline time.Time, ok bool) {
-	return
+	return c.getParent().Deadline()
 }
 
 // Done returns a channel that's closed when work done on behalf of this
 // contextx should be canceled. Done may return nil if this contextx can
 // never be canceled. Successive calls to Done return the same value.
 func (c *Context) Done() <-chan struct{} {
-	c.SpanFinish(c.TopSpan)
-	return nil
+	return c.getParent().Done()
 }
 
 // Err returns a non-nil error value after Done is closed,
@@ -55,16 +115,18 @@ func (c *Context) Done() <-chan struct{} {
 // Canceled if the contextx was canceled
 // or DeadlineExceeded if the contextx's deadline passed.
 func (c *Context) Err() error {
-	return nil
+	return c.getParent().Err()
 }
 
 // Value returns the value associated with this contextx for key, or nil
 // if no value is associated with key. Successive calls to Value with
 // the same key returns the same result.
+// string类型的key优先从 MemoryContext 中查找, 找不到再查找parent
 func (c *Context) Value(key interface{}) interface{} {
 	if keyAsString, ok := key.(string); ok {
-		val, _ := c.Get(keyAsString)
-		return val
+		if val, exists := c.Get(keyAsString); exists {
+			return val
+		}
 	}
-	return nil
+	return c.getParent().Value(key)
 }
@@ -0,0 +1,142 @@
+package appx
+
+import (
+	"context"
+	"fmt"
+	"github.com/laydong/toolpkg/alarmx"
+	"github.com/opentracing/opentracing-go/ext"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	JobStatusSuccess = "success" // 执行成功
+	JobStatusFailed  = "failed"  // 返回了error
+	JobStatusPanic   = "panic"   // 发生了panic
+
+	jobNameKey = "job_name"
+)
+
+// JobFunc 后台任务, 定时任务和消费者等都可以包装成JobFunc
+type JobFunc func(ctx *Context) error
+
+// JobResult 任务执行结果
+type JobResult struct {
+	Name     string        `json:"name"`
+	LogId    string        `json:"log_id"`
+	Status   string        `json:"status"`
+	Err      error         `json:"-"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Job 后台任务, 负责创建context、恢复panic、记录日志和链路、失败告警
+type Job struct {
+	Name    string
+	Run     JobFunc
+	Timeout time.Duration // 单次执行的超时时间, 0表示不限制
+	NoAlarm bool          // 失败时不发送告警
+
+	BeforeRun func(ctx *Context)                    // 任务开始前执行
+	AfterRun  func(ctx *Context, result *JobResult) // 任务结束后执行, 无论成功失败
+}
+
+// NewJob 创建任务
+func NewJob(name string, fn JobFunc) *Job {
+	return &Job{
+		Name: name,
+		Run:  fn,
+	}
+}
+
+// RunJob 以默认配置执行一次任务, 返回任务的错误, panic会被转换成error
+func RunJob(name string, fn JobFunc) error {
+	return NewJob(name, fn).Execute(context.Background(), "").Err
+}
+
+// Execute 执行一次任务, 每次执行都会创建新的context, logId为空时自动生成
+func (j *Job) Execute(parent context.Context, logId string) (result *JobResult) {
+	ctx := NewContext(parent, logId, j.Name)
+	ctx.Set(jobNameKey, j.Name)
+	if j.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = ctx.WithTimeout(j.Timeout)
+		defer cancel()
+	}
+
+	result = &JobResult{
+		Name:  j.Name,
+		LogId: ctx.GetLogId(),
+		Start: time.Now(),
+	}
+	if j.BeforeRun != nil {
+		j.BeforeRun(ctx)
+	}
+
+	result.Status, result.Err = j.call(ctx)
+	result.Duration = time.Since(result.Start)
+
+	j.finish(ctx, result)
+	if j.AfterRun != nil {
+		j.AfterRun(ctx, result)
+	}
+	return
+}
+
+// call 执行任务并恢复panic
+func (j *Job) call(ctx *Context) (status string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			status = JobStatusPanic
+			err = fmt.Errorf("job %s panic: %v", j.Name, r)
+			ctx.ErrorF("%s", err.Error(),
+				ctx.Field("title", "任务panic"),
+				ctx.Field("stack", string(debug.Stack())))
+		}
+	}()
+
+	if err = j.Run(ctx); err != nil {
+		return JobStatusFailed, err
+	}
+	return JobStatusSuccess, nil
+}
+
+// finish 记录日志、结束span、失败时告警
+func (j *Job) finish(ctx *Context, result *JobResult) {
+	runTime := fmt.Sprintf("%.3fms", float64(result.Duration.Nanoseconds())/1e6)
+	if span := ctx.TopSpan; span != nil {
+		span.SetTag("job.name", j.Name)
+		span.SetTag("job.status", result.Status)
+		if result.Err != nil {
+			ext.Error.Set(span, true)
+			span.LogKV("error", result.Err.Error())
+		}
+	}
+	ctx.Finish()
+
+	if result.Err == nil {
+		ctx.InfoF("job_log",
+			ctx.Field(jobNameKey, j.Name),
+			ctx.Field("status", result.Status),
+			ctx.Field("run_time", runTime))
+		return
+	}
+
+	ctx.ErrorF("job_log",
+		ctx.Field(jobNameKey, j.Name),
+		ctx.Field("status", result.Status),
+		ctx.Field("error", result.Err.Error()),
+		ctx.Field("run_time", runTime))
+	if !j.NoAlarm {
+		alarmx.SendDing(&alarmx.AlarmData{
+			Title:       "任务执行失败",
+			Description: j.Name,
+			Content: map[string]interface{}{
+				"log_id":   result.LogId,
+				"status":   result.Status,
+				"error":    result.Err.Error(),
+				"run_time": runTime,
+			},
+		})
+	}
+}
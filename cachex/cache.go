@@ -0,0 +1,398 @@
+package cachex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/laydong/toolpkg/logx"
+	uuid "github.com/satori/go.uuid"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+	"gorm.io/gorm"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPrefix      = "cachex:"
+	defaultTTL         = 10 * time.Minute
+	defaultJitter      = 0.1
+	defaultNegativeTTL = time.Minute
+	defaultLocalTTL    = time.Minute
+	defaultLoadTimeout = 10 * time.Second
+
+	negativeValue = "__cachex_nil__" // 负缓存的值, 表示数据不存在
+
+	resultHit      = "hit"
+	resultLocalHit = "local_hit"
+	resultMiss     = "miss"
+	resultNegative = "negative"
+	resultError    = "error"
+)
+
+// ErrNotFound 缓存不存在, 或数据不存在被负缓存, loader返回它或 gorm.ErrRecordNotFound 时写入负缓存
+var ErrNotFound = errors.New("cachex: not found")
+
+// errMiss redis和本地都没有缓存, 区别于负缓存
+var errMiss = errors.New("cachex: miss")
+
+// LoadFunc 缓存不存在时从数据源加载
+type LoadFunc func(ctx context.Context) (interface{}, error)
+
+// Options 缓存选项
+type Options struct {
+	Prefix      string        // key前缀, 默认 cachex:
+	Codec       Codec         // 编解码, 默认 JSON
+	TTL         time.Duration // 默认过期时间, 默认10分钟
+	Jitter      float64       // 过期时间随机浮动的比例, 默认0.1即±10%, 避免同时过期, 小于0不浮动
+	NegativeTTL time.Duration // 负缓存过期时间, 默认1分钟, 小于等于0不缓存不存在的数据
+	LocalSize   int           // 本地LRU缓存的数量, 为0不开启
+	LocalTTL    time.Duration // 本地缓存的过期时间, 默认1分钟, 不超过redis的过期时间
+	Channel     string        // 本地缓存失效通知的频道, 默认 前缀+invalidate
+	LoadTimeout time.Duration // GetOrLoad 加载的超时, 默认10秒, 加载不受调用方ctx取消的影响
+}
+
+type OptionFunc func(*Options)
+
+// WithPrefix 设置key前缀
+func WithPrefix(prefix string) OptionFunc {
+	return func(o *Options) {
+		o.Prefix = prefix
+	}
+}
+
+// WithCodec 设置编解码, 如 cachex.Msgpack
+func WithCodec(c Codec) OptionFunc {
+	return func(o *Options) {
+		if c != nil {
+			o.Codec = c
+		}
+	}
+}
+
+// WithTTL 设置默认过期时间和随机浮动比例
+func WithTTL(ttl time.Duration, jitter float64) OptionFunc {
+	return func(o *Options) {
+		if ttl > 0 {
+			o.TTL = ttl
+		}
+		o.Jitter = jitter
+	}
+}
+
+// WithNegativeTTL 设置负缓存过期时间, 小于等于0不缓存不存在的数据, redis中过期时间为0的key不会过期, 所以0也表示关闭
+func WithNegativeTTL(ttl time.Duration) OptionFunc {
+	return func(o *Options) {
+		o.NegativeTTL = ttl
+	}
+}
+
+// WithLoadTimeout 设置 GetOrLoad 加载的超时
+func WithLoadTimeout(timeout time.Duration) OptionFunc {
+	return func(o *Options) {
+		if timeout > 0 {
+			o.LoadTimeout = timeout
+		}
+	}
+}
+
+// WithLocal 开启本地LRU缓存, 其他副本修改或删除时通过redis pub/sub通知失效
+func WithLocal(size int, ttl time.Duration) OptionFunc {
+	return func(o *Options) {
+		o.LocalSize = size
+		if ttl > 0 {
+			o.LocalTTL = ttl
+		}
+	}
+}
+
+// Cache 旁路缓存, redis为共享的缓存, 可选的本地LRU在redis之前
+type Cache struct {
+	rdb   redis.UniversalClient
+	opts  Options
+	id    string // 区分自己发出的失效通知
+	group singleflight.Group
+	local *localCache
+	sub   *redis.PubSub
+}
+
+// New 创建缓存, rdb 通常为 db.InitRdb 或 appx.App.Redis() 返回的客户端
+func New(rdb redis.UniversalClient, opts ...OptionFunc) *Cache {
+	o := Options{
+		Prefix:      defaultPrefix,
+		Codec:       JSON,
+		TTL:         defaultTTL,
+		Jitter:      defaultJitter,
+		NegativeTTL: defaultNegativeTTL,
+		LocalTTL:    defaultLocalTTL,
+		LoadTimeout: defaultLoadTimeout,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+	if o.Channel == "" {
+		o.Channel = o.Prefix + "invalidate"
+	}
+	c := &Cache{rdb: rdb, opts: o, id: uuid.NewV4().String()}
+	if o.LocalSize > 0 {
+		c.local = newLocalCache(o.LocalSize)
+		c.sub = rdb.Subscribe(context.Background(), o.Channel)
+		go c.listen(c.sub.Channel())
+	}
+	return c
+}
+
+// Close 停止接收本地缓存的失效通知
+func (c *Cache) Close() error {
+	if c.sub == nil {
+		return nil
+	}
+	return c.sub.Close()
+}
+
+// Get 获取缓存并解码到v, 不存在或被负缓存时返回 ErrNotFound
+func (c *Cache) Get(ctx context.Context, key string, v interface{}) error {
+	data, err := c.get(ctx, key)
+	if err == errMiss {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return c.decode(data, v)
+}
+
+// Set 写入缓存, ttl为0时使用默认过期时间
+func (c *Cache) Set(ctx context.Context, key string, v interface{}, ttl time.Duration) error {
+	data, err := c.opts.Codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("cachex: marshal %s failed: %w", key, err)
+	}
+	return c.set(ctx, key, data, c.ttl(ttl))
+}
+
+// Delete 删除缓存, 同时通知其他副本删除本地缓存
+func (c *Cache) Delete(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	full := make([]string, 0, len(keys))
+	for _, key := range keys {
+		full = append(full, c.opts.Prefix+key)
+	}
+	if err := c.rdb.Del(ctx, full...).Err(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		c.invalidate(ctx, key)
+	}
+	return nil
+}
+
+// GetOrLoad 获取缓存, 不存在时调用load加载并写入缓存
+// 同一个进程内并发加载同一个key时只有一个会执行load, redis出错时直接加载
+// load使用的ctx保留第一个调用方ctx中的值, 但不随它取消, 超时为 LoadTimeout, 每个调用方只等待到自己的ctx结束
+func (c *Cache) GetOrLoad(ctx context.Context, key string, v interface{}, ttl time.Duration, load LoadFunc) error {
+	data, err := c.get(ctx, key)
+	if err == nil {
+		return c.decode(data, v)
+	}
+	if err == ErrNotFound {
+		return err
+	}
+
+	ch := c.group.DoChan(key, func() (val interface{}, err error) {
+		// DoChan中的panic会导致进程退出, 转换为错误
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("cachex: load %s panic: %v", key, r)
+			}
+		}()
+		loadCtx, cancel := context.WithTimeout(detach(ctx), c.opts.LoadTimeout)
+		defer cancel()
+		return c.load(loadCtx, key, ttl, load)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return res.Err
+		}
+		return c.decode(res.Val.([]byte), v)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// load 加载并写入缓存, 数据不存在时写入负缓存
+func (c *Cache) load(ctx context.Context, key string, ttl time.Duration, load LoadFunc) (interface{}, error) {
+	res, err := load(ctx)
+	if err != nil {
+		if c.opts.NegativeTTL > 0 && isNotFound(err) {
+			c.setNegative(ctx, key)
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	data, err := c.opts.Codec.Marshal(res)
+	if err != nil {
+		return nil, fmt.Errorf("cachex: marshal %s failed: %w", key, err)
+	}
+	if err := c.set(ctx, key, data, c.ttl(ttl)); err != nil {
+		c.log(ctx, key, resultError, 0, err)
+	}
+	return data, nil
+}
+
+// get 依次查找本地缓存和redis, redis命中时写入本地缓存, 负缓存返回 ErrNotFound, 没有缓存返回 errMiss
+func (c *Cache) get(ctx context.Context, key string) ([]byte, error) {
+	begin := time.Now()
+	if c.local != nil {
+		if data, ok := c.local.get(key); ok {
+			if string(data) == negativeValue {
+				c.log(ctx, key, resultNegative, time.Since(begin), nil)
+				return nil, ErrNotFound
+			}
+			c.log(ctx, key, resultLocalHit, time.Since(begin), nil)
+			return data, nil
+		}
+	}
+
+	fullKey := c.opts.Prefix + key
+	pipe := c.rdb.Pipeline()
+	getCmd := pipe.Get(ctx, fullKey)
+	ttlCmd := pipe.PTTL(ctx, fullKey)
+	_, err := pipe.Exec(ctx)
+	data, getErr := getCmd.Bytes()
+	if getErr == redis.Nil {
+		c.log(ctx, key, resultMiss, time.Since(begin), nil)
+		return nil, errMiss
+	}
+	if err != nil {
+		c.log(ctx, key, resultError, time.Since(begin), err)
+		return nil, err
+	}
+
+	if c.local != nil {
+		c.setLocal(key, data, ttlCmd.Val())
+	}
+	if string(data) == negativeValue {
+		c.log(ctx, key, resultNegative, time.Since(begin), nil)
+		return nil, ErrNotFound
+	}
+	c.log(ctx, key, resultHit, time.Since(begin), nil)
+	return data, nil
+}
+
+func (c *Cache) set(ctx context.Context, key string, data []byte, ttl time.Duration) error {
+	if err := c.rdb.Set(ctx, c.opts.Prefix+key, data, ttl).Err(); err != nil {
+		return err
+	}
+	c.invalidate(ctx, key)
+	if c.local != nil {
+		c.setLocal(key, data, ttl)
+	}
+	return nil
+}
+
+func (c *Cache) setNegative(ctx context.Context, key string) {
+	if err := c.set(ctx, key, []byte(negativeValue), c.jitter(c.opts.NegativeTTL)); err != nil {
+		c.log(ctx, key, resultError, 0, err)
+	}
+}
+
+// setLocal 本地缓存的过期时间不超过redis剩余的过期时间
+func (c *Cache) setLocal(key string, data []byte, ttl time.Duration) {
+	localTTL := c.opts.LocalTTL
+	if ttl > 0 && ttl < localTTL {
+		localTTL = ttl
+	}
+	c.local.set(key, data, localTTL)
+}
+
+func (c *Cache) decode(data []byte, v interface{}) error {
+	if err := c.opts.Codec.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("cachex: unmarshal %s failed: %w", c.opts.Codec.Name(), err)
+	}
+	return nil
+}
+
+func (c *Cache) ttl(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = c.opts.TTL
+	}
+	return c.jitter(ttl)
+}
+
+// jitter 过期时间随机浮动, 避免同时写入的key同时过期
+func (c *Cache) jitter(ttl time.Duration) time.Duration {
+	if c.opts.Jitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+	delta := int64(float64(ttl) * c.opts.Jitter)
+	if delta <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(rand.Int63n(2*delta+1)-delta)
+}
+
+// invalidate 删除本地缓存并通知其他副本, 消息格式为 实例id 空格 key
+func (c *Cache) invalidate(ctx context.Context, key string) {
+	if c.local == nil {
+		return
+	}
+	c.local.delete(key)
+	if err := c.rdb.Publish(ctx, c.opts.Channel, c.id+" "+key).Err(); err != nil {
+		log.Printf("[cachex] publish invalidate %s failed: %s", key, err.Error())
+	}
+}
+
+// listen 接收其他副本的失效通知, 断线期间丢失的通知由本地缓存的过期时间兜底
+func (c *Cache) listen(ch <-chan *redis.Message) {
+	for msg := range ch {
+		id, key, ok := strings.Cut(msg.Payload, " ")
+		if !ok || id == c.id {
+			continue
+		}
+		c.local.delete(key)
+	}
+}
+
+func (c *Cache) log(ctx context.Context, key, result string, elapsed time.Duration, err error) {
+	requestId := logx.RequestIdFromContext(ctx)
+	if requestId == "" {
+		requestId = "null"
+	}
+	fields := []interface{}{
+		zap.String(logx.MessageType, "cache_log"),
+		zap.String(logx.RequestIdKey, requestId),
+		zap.String("key", c.opts.Prefix+key),
+		zap.String("result", result),
+		zap.String("run_time", fmt.Sprintf("%.3fms", float64(elapsed.Nanoseconds())/1e6)),
+	}
+	if err != nil {
+		logx.Error("cache_log", append(fields, zap.String("error", err.Error()))...)
+		return
+	}
+	logx.Info("cache_log", fields...)
+}
+
+// detachedContext 保留父ctx中的值, 但不继承取消和超时
+type detachedContext struct {
+	parent context.Context
+}
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+func (detachedContext) Deadline() (deadline time.Time, ok bool) { return }
+func (detachedContext) Done() <-chan struct{}                   { return nil }
+func (detachedContext) Err() error                              { return nil }
+func (c detachedContext) Value(key interface{}) interface{}     { return c.parent.Value(key) }
+
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, gorm.ErrRecordNotFound)
+}
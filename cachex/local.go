@@ -0,0 +1,70 @@
+package cachex
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// localCache 进程内的LRU缓存, 保存编码后的值
+type localCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type localEntry struct {
+	key      string
+	data     []byte
+	expireAt time.Time
+}
+
+func newLocalCache(size int) *localCache {
+	return &localCache{size: size, ll: list.New(), items: make(map[string]*list.Element, size)}
+}
+
+func (c *localCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*localEntry)
+	if time.Now().After(e.expireAt) {
+		c.remove(el)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e.data, true
+}
+
+func (c *localCache) set(key string, data []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expireAt := time.Now().Add(ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*localEntry)
+		e.data, e.expireAt = data, expireAt
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&localEntry{key: key, data: data, expireAt: expireAt})
+	for c.ll.Len() > c.size {
+		c.remove(c.ll.Back())
+	}
+}
+
+func (c *localCache) delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *localCache) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*localEntry).key)
+}
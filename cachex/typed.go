@@ -0,0 +1,40 @@
+package cachex
+
+import (
+	"context"
+	"time"
+)
+
+// Typed 指定值类型的缓存, 不需要每次传入指针
+type Typed[T any] struct {
+	c *Cache
+}
+
+// NewTyped 创建指定值类型的缓存, 多个类型可以共用一个 Cache
+func NewTyped[T any](c *Cache) *Typed[T] {
+	return &Typed[T]{c: c}
+}
+
+// Get 获取缓存, 不存在时返回 ErrNotFound
+func (t *Typed[T]) Get(ctx context.Context, key string) (v T, err error) {
+	err = t.c.Get(ctx, key, &v)
+	return
+}
+
+// Set 写入缓存, ttl为0时使用默认过期时间
+func (t *Typed[T]) Set(ctx context.Context, key string, v T, ttl time.Duration) error {
+	return t.c.Set(ctx, key, v, ttl)
+}
+
+// Delete 删除缓存
+func (t *Typed[T]) Delete(ctx context.Context, keys ...string) error {
+	return t.c.Delete(ctx, keys...)
+}
+
+// GetOrLoad 获取缓存, 不存在时调用load加载并写入缓存, load返回 ErrNotFound 或 gorm.ErrRecordNotFound 时写入负缓存
+func (t *Typed[T]) GetOrLoad(ctx context.Context, key string, ttl time.Duration, load func(ctx context.Context) (T, error)) (v T, err error) {
+	err = t.c.GetOrLoad(ctx, key, &v, ttl, func(ctx context.Context) (interface{}, error) {
+		return load(ctx)
+	})
+	return
+}
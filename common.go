@@ -9,16 +9,18 @@ import (
 )
 
 type AppConf struct {
-	AppName       string        `json:"app_name"`       // 默认应用名称
-	AppMode       string        `json:"app_mode"`       // 默认应用环境
-	LogType       string        `json:"log_type"`       // 默认日志类型
-	LogPath       string        `json:"log_path"`       // 默认文件目录
-	ChildPath     string        `json:"child_path"`     // 默认子目录
-	RotationSize  int           `json:"rotation_size"`  // 默认大小为32M
-	RotationCount int           `json:"rotation_count"` // 默认不限制
-	RotationTime  time.Duration `json:"rotation_time"`  // 默认每天轮转一次
-	NoBuffWrite   bool          `json:"no_buff_write"`  // 不不开启无缓冲写入
-	MaxAge        time.Duration `json:"max_age"`        // 默认保留90天
+	AppName       string        `json:"app_name" validate:"required"` // 应用名称, 通过 confx 加载时必填
+	AppMode       string        `json:"app_mode"`                     // 默认应用环境
+	LogType       string        `json:"log_type"`                     // 默认日志类型
+	LogPath       string        `json:"log_path"`                     // 默认文件目录
+	ChildPath     string        `json:"child_path"`                   // 默认子目录
+	RotationSize  int           `json:"rotation_size"`                // 默认大小为32M
+	RotationCount int           `json:"rotation_count"`               // 默认不限制
+	RotationTime  time.Duration `json:"rotation_time"`                // 默认每天轮转一次
+	NoBuffWrite   bool          `json:"no_buff_write"`                // 不不开启无缓冲写入
+	MaxAge        time.Duration `json:"max_age"`                      // 默认保留90天
+	LogLevel      string        `json:"log_level"`                    // 默认info
+	AuditPath     string        `json:"audit_path"`                   // 审计日志子目录, 默认 /audit-%s.log
 }
 
 // InitLog 初始化日志服务
@@ -35,6 +37,8 @@ func InitLog(conf AppConf) {
 		NoBuffWrite:   logx.DefaultNoBuffWrite,
 		RotationTime:  logx.DefaultRotationTime,
 		MaxAge:        logx.DefaultMaxAge,
+		LogLevel:      logx.DefaultLogLevel,
+		AuditPath:     logx.DefaultAuditPath,
 	}
 	if conf.AppName != "" {
 		defaultConfig.AppName = conf.AppName
@@ -67,6 +71,12 @@ func InitLog(conf AppConf) {
 	if conf.MaxAge > 0 {
 		defaultConfig.MaxAge = conf.MaxAge
 	}
+	if conf.LogLevel != "" {
+		defaultConfig.LogLevel = conf.LogLevel
+	}
+	if conf.AuditPath != "" {
+		defaultConfig.AuditPath = conf.AuditPath
+	}
 	logx.InitLog(&defaultConfig)
 }
 
@@ -0,0 +1,214 @@
+package confx
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	DefaultEnvPrefix = "APP_"     // 默认环境变量前缀
+	EnvAppMode       = "APP_MODE" // 指定运行环境的环境变量
+	keyAppMode       = "app_mode" // 配置文件中的运行环境字段
+	envKeySeparator  = "__"       // 环境变量中嵌套字段的分隔符 APP_MYSQL__DSN -> mysql.dsn
+)
+
+// Validator 配置结构体可以实现该接口做额外的校验
+type Validator interface {
+	Validate() error
+}
+
+// Options 加载选项
+type Options struct {
+	EnvPrefix string // 环境变量前缀, 默认APP_
+	Mode      string // 运行环境, 为空时依次取APP_MODE环境变量和配置文件中的app_mode
+}
+
+type OptionFunc func(*Options)
+
+// WithEnvPrefix 设置环境变量前缀, 传空字符串表示不读取环境变量
+func WithEnvPrefix(prefix string) OptionFunc {
+	return func(o *Options) {
+		o.EnvPrefix = prefix
+	}
+}
+
+// WithMode 指定运行环境, 用于选择叠加的环境配置文件
+func WithMode(mode string) OptionFunc {
+	return func(o *Options) {
+		o.Mode = mode
+	}
+}
+
+var validate = validator.New()
+
+// Load 加载配置文件并解码到v, v必须是结构体指针, 字段按json tag匹配
+// 1. 读取基础配置文件 path, 支持 yaml/yml/json/toml
+// 2. 叠加环境配置文件, 如 config.yaml 在 AppMode=prod 时叠加 config.prod.yaml, 文件不存在则跳过
+// 3. 应用 APP_* 环境变量, 如 APP_LOG_PATH -> log_path, APP_MYSQL__DSN -> mysql.dsn
+// 4. 解码后按 validate tag 校验必填项, 实现了 Validator 接口的还会调用 Validate
+func Load(path string, v interface{}, opts ...OptionFunc) error {
+	data, err := LoadMap(path, opts...)
+	if err != nil {
+		return err
+	}
+	return Decode(data, v)
+}
+
+// LoadMap 按 Load 的规则加载配置, 返回合并后的原始数据
+func LoadMap(path string, opts ...OptionFunc) (map[string]interface{}, error) {
+	o := Options{EnvPrefix: DefaultEnvPrefix}
+	for _, f := range opts {
+		f(&o)
+	}
+
+	data, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := o.Mode
+	if mode == "" {
+		mode = os.Getenv(EnvAppMode)
+	}
+	if mode == "" {
+		mode, _ = data[keyAppMode].(string)
+	}
+	if mode != "" {
+		data[keyAppMode] = mode
+		overlay := overlayPath(path, mode)
+		if _, err = os.Stat(overlay); err == nil {
+			over, err := readFile(overlay)
+			if err != nil {
+				return nil, err
+			}
+			merge(data, over)
+		}
+	}
+
+	if o.EnvPrefix != "" {
+		applyEnv(data, o.EnvPrefix)
+	}
+	return data, nil
+}
+
+// Decode 将合并后的原始数据解码到v并校验
+func Decode(data map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(normalize(data, typeOf(v)))
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("confx: decode failed: %w", err)
+	}
+	return Validate(v)
+}
+
+// Validate 校验配置
+func Validate(v interface{}) error {
+	if err := validate.Struct(v); err != nil {
+		if _, ok := err.(*validator.InvalidValidationError); !ok {
+			return fmt.Errorf("confx: validate failed: %w", err)
+		}
+	}
+	if vv, ok := v.(Validator); ok {
+		if err := vv.Validate(); err != nil {
+			return fmt.Errorf("confx: validate failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// overlayPath config.yaml + prod -> config.prod.yaml
+func overlayPath(path, mode string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + mode + ext
+}
+
+func readFile(path string) (map[string]interface{}, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var raw map[interface{}]interface{}
+		err = yaml.Unmarshal(b, &raw)
+		if err == nil {
+			data, _ = convertYaml(raw).(map[string]interface{})
+		}
+	case ".json":
+		err = json.Unmarshal(b, &data)
+	case ".toml":
+		err = toml.Unmarshal(b, &data)
+	default:
+		return nil, fmt.Errorf("confx: unsupported config file %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("confx: parse %s failed: %w", path, err)
+	}
+	if data == nil {
+		data = make(map[string]interface{})
+	}
+	return data, nil
+}
+
+// convertYaml yaml.v2 解析出的map的key是interface{}, 转成string方便合并和json编码
+func convertYaml(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, vv := range t {
+			m[fmt.Sprintf("%v", k)] = convertYaml(vv)
+		}
+		return m
+	case []interface{}:
+		for i, vv := range t {
+			t[i] = convertYaml(vv)
+		}
+		return t
+	}
+	return v
+}
+
+// merge 将src深度合并到dst, map递归合并, 其他类型直接覆盖
+func merge(dst, src map[string]interface{}) {
+	for k, sv := range src {
+		if sm, ok := sv.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				merge(dm, sm)
+				continue
+			}
+		}
+		dst[k] = sv
+	}
+}
+
+// applyEnv 应用环境变量, key转小写, 嵌套字段以 __ 分隔
+func applyEnv(data map[string]interface{}, prefix string) {
+	for _, kv := range os.Environ() {
+		idx := strings.Index(kv, "=")
+		if idx <= 0 || !strings.HasPrefix(kv[:idx], prefix) || kv[:idx] == EnvAppMode {
+			continue
+		}
+		keys := strings.Split(strings.ToLower(kv[len(prefix):idx]), envKeySeparator)
+		m := data
+		for _, k := range keys[:len(keys)-1] {
+			child, ok := m[k].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				m[k] = child
+			}
+			m = child
+		}
+		m[keys[len(keys)-1]] = kv[idx+1:]
+	}
+}
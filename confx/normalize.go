@@ -0,0 +1,137 @@
+package confx
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func typeOf(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// normalize 按目标类型转换原始数据, 使其可以被json正确解码
+// 环境变量和部分配置文件中的值都是字符串, 如 "24h" -> time.Duration, "10" -> int, "a,b" -> []string
+func normalize(v interface{}, t reflect.Type) interface{} {
+	if v == nil || t == nil {
+		return v
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == durationType {
+		switch d := v.(type) {
+		case string:
+			if pd, err := time.ParseDuration(d); err == nil {
+				return int64(pd)
+			}
+		}
+		return v
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		normalizeStruct(m, t)
+		return m
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		for k, mv := range m {
+			m[k] = normalize(mv, t.Elem())
+		}
+		return m
+	case reflect.Slice, reflect.Array:
+		switch s := v.(type) {
+		case string:
+			var items []interface{}
+			for _, item := range strings.Split(s, ",") {
+				items = append(items, normalize(strings.TrimSpace(item), t.Elem()))
+			}
+			return items
+		case []interface{}:
+			for i, item := range s {
+				s[i] = normalize(item, t.Elem())
+			}
+			return s
+		}
+	case reflect.String:
+		switch v.(type) {
+		case string, map[string]interface{}, []interface{}:
+			return v
+		}
+		return fmt.Sprintf("%v", v)
+	case reflect.Bool:
+		if s, ok := v.(string); ok {
+			if b, err := strconv.ParseBool(s); err == nil {
+				return b
+			}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if s, ok := v.(string); ok {
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return i
+			}
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if s, ok := v.(string); ok {
+			if i, err := strconv.ParseUint(s, 10, 64); err == nil {
+				return i
+			}
+		}
+	case reflect.Float32, reflect.Float64:
+		if s, ok := v.(string); ok {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return f
+			}
+		}
+	}
+	return v
+}
+
+// normalizeStruct 按json tag找到字段并转换, 匿名嵌入且没有tag的结构体字段会被展开
+func normalizeStruct(m map[string]interface{}, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				normalizeStruct(m, ft)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		for k, v := range m {
+			if strings.EqualFold(k, name) {
+				m[k] = normalize(v, f.Type)
+			}
+		}
+	}
+}
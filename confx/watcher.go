@@ -0,0 +1,165 @@
+package confx
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReloadDelay = 100 * time.Millisecond // 合并短时间内的多次文件变更
+	k8sDataDir         = "..data"               // k8s configmap 通过替换该软链接更新配置
+)
+
+// Subscriber 配置变更订阅者, old/new 是变更前后的配置, 类型与 NewWatcher 传入的 v 相同
+// 返回error表示拒绝本次变更, 此时已经通知过的订阅者会以 (new, old) 再次被调用用于回滚
+type Subscriber func(old, new interface{}) error
+
+// Watcher 监听配置文件, 变更后重新加载并通知订阅者
+type Watcher struct {
+	path string
+	opts []OptionFunc
+	typ  reflect.Type
+
+	mu      sync.RWMutex
+	current interface{}
+
+	subLock     sync.Mutex
+	subscribers []Subscriber
+
+	fsw       *fsnotify.Watcher
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWatcher 加载配置到v并开始监听配置文件所在目录, v必须是结构体指针
+// 之后的变更不会写回v, 需要通过 Get 或订阅者拿到最新的配置
+func NewWatcher(path string, v interface{}, opts ...OptionFunc) (*Watcher, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return nil, errors.New("confx: watcher needs a non-nil pointer")
+	}
+	if err := Load(path, v, opts...); err != nil {
+		return nil, err
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err = fsw.Add(filepath.Dir(path)); err != nil {
+		_ = fsw.Close()
+		return nil, err
+	}
+
+	w := &Watcher{
+		path:    path,
+		opts:    opts,
+		typ:     rv.Elem().Type(),
+		current: v,
+		fsw:     fsw,
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Get 获取当前生效的配置
+func (w *Watcher) Get() interface{} {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.current
+}
+
+// Subscribe 注册订阅者, 按注册顺序通知
+func (w *Watcher) Subscribe(s ...Subscriber) {
+	w.subLock.Lock()
+	w.subscribers = append(w.subscribers, s...)
+	w.subLock.Unlock()
+}
+
+// Reload 重新加载配置并通知订阅者, 配置没有变化时不通知
+// 加载失败或者被订阅者拒绝时保持原配置不变
+func (w *Watcher) Reload() error {
+	nv := reflect.New(w.typ).Interface()
+	if err := Load(w.path, nv, w.opts...); err != nil {
+		return err
+	}
+
+	w.subLock.Lock()
+	defer w.subLock.Unlock()
+
+	old := w.Get()
+	if reflect.DeepEqual(old, nv) {
+		return nil
+	}
+	for i, s := range w.subscribers {
+		if err := s(old, nv); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				_ = w.subscribers[j](nv, old)
+			}
+			return fmt.Errorf("confx: change rejected: %w", err)
+		}
+	}
+
+	w.mu.Lock()
+	w.current = nv
+	w.mu.Unlock()
+	return nil
+}
+
+// Close 停止监听
+func (w *Watcher) Close() (err error) {
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.fsw.Close()
+	})
+	return
+}
+
+func (w *Watcher) run() {
+	timer := time.NewTimer(defaultReloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case event, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 && w.match(event.Name) {
+				timer.Reset(defaultReloadDelay)
+			}
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("[confx] watch %s err: %s", w.path, err.Error())
+		case <-timer.C:
+			if err := w.Reload(); err != nil {
+				log.Printf("[confx] reload %s err: %s", w.path, err.Error())
+			} else {
+				log.Printf("[confx] reload %s success", w.path)
+			}
+		}
+	}
+}
+
+// match 只关心基础配置文件和它的环境配置文件, 如 config.yaml 和 config.*.yaml
+func (w *Watcher) match(name string) bool {
+	base, file := filepath.Base(w.path), filepath.Base(name)
+	if file == base || file == k8sDataDir {
+		return true
+	}
+	ext := filepath.Ext(base)
+	return strings.HasPrefix(file, strings.TrimSuffix(base, ext)+".") && strings.HasSuffix(file, ext)
+}
@@ -0,0 +1,221 @@
+package cronx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/laydong/toolpkg/appx"
+	"github.com/laydong/toolpkg/logx"
+	"github.com/laydong/toolpkg/utils"
+	"github.com/robfig/cron/v3"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLockPrefix = "cronx:lock:" // 分布式锁key前缀
+	defaultLockTTL    = time.Minute   // 分布式锁默认过期时间
+)
+
+// parser 秒字段可选的cron表达式解析器
+var parser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// Options 调度器选项
+type Options struct {
+	Rdb        redis.UniversalClient // 开启分布式锁时使用的redis
+	LockPrefix string                // 分布式锁key前缀, 默认 cronx:lock:
+	Location   *time.Location        // cron表达式使用的时区, 默认本地时区
+}
+
+type OptionFunc func(*Options)
+
+// WithRedisLock 设置分布式锁使用的redis, 任务还需要通过 WithLock 开启锁
+func WithRedisLock(rdb redis.UniversalClient) OptionFunc {
+	return func(o *Options) {
+		o.Rdb = rdb
+	}
+}
+
+// WithLockPrefix 设置分布式锁key前缀, 多个应用共用redis时用来区分
+func WithLockPrefix(prefix string) OptionFunc {
+	return func(o *Options) {
+		if prefix != "" {
+			o.LockPrefix = prefix
+		}
+	}
+}
+
+// WithLocation 设置cron表达式使用的时区
+func WithLocation(loc *time.Location) OptionFunc {
+	return func(o *Options) {
+		if loc != nil {
+			o.Location = loc
+		}
+	}
+}
+
+// JobOptions 任务选项
+type JobOptions struct {
+	SkipIfRunning bool          // 上一次还没执行完时跳过本次
+	Lock          bool          // 多副本部署时每次触发只有抢到锁的副本执行
+	LockTTL       time.Duration // 锁的过期时间, 执行完不释放, 应大于副本之间的时钟误差, 小于触发间隔
+}
+
+type JobOptionFunc func(*JobOptions)
+
+// SkipIfRunning 上一次还没执行完时跳过本次执行
+func SkipIfRunning() JobOptionFunc {
+	return func(o *JobOptions) {
+		o.SkipIfRunning = true
+	}
+}
+
+// WithLock 使用redis锁保证每次触发只有一个副本执行, 锁的key包含本次触发的时间
+// 执行完不释放锁, 由ttl过期, 时钟或调度稍晚的副本不会重复执行同一次触发, ttl为0时使用默认值1分钟
+// 不同触发之间不互斥, 执行时间可能超过触发间隔时配合 SkipIfRunning 使用
+func WithLock(ttl time.Duration) JobOptionFunc {
+	return func(o *JobOptions) {
+		o.Lock = true
+		if ttl > 0 {
+			o.LockTTL = ttl
+		}
+	}
+}
+
+// Scheduler 定时任务调度器, 支持cron表达式和固定间隔
+// 每次执行都会创建新的 appx.Context, 拥有独立的log id和span
+type Scheduler struct {
+	opts Options
+	cron *cron.Cron
+}
+
+// NewScheduler 创建调度器, cron表达式支持可选的秒字段, 如 "0 */5 * * * *" 和 "*/5 * * * *"
+func NewScheduler(opts ...OptionFunc) *Scheduler {
+	o := Options{
+		LockPrefix: defaultLockPrefix,
+		Location:   time.Local,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+
+	return &Scheduler{
+		opts: o,
+		cron: cron.New(cron.WithParser(parser), cron.WithLocation(o.Location), cron.WithLogger(cronLogger{})),
+	}
+}
+
+// AddJob 按cron表达式添加任务, 也支持 @every 1m、@daily 等描述符
+func (s *Scheduler) AddJob(spec string, job *appx.Job, opts ...JobOptionFunc) (cron.EntryID, error) {
+	schedule, err := parser.Parse(spec)
+	if err != nil {
+		return 0, fmt.Errorf("cronx: parse %s failed: %w", spec, err)
+	}
+	return s.schedule(schedule, job, opts...)
+}
+
+// AddFunc 按cron表达式添加任务
+func (s *Scheduler) AddFunc(spec, name string, fn appx.JobFunc, opts ...JobOptionFunc) (cron.EntryID, error) {
+	return s.AddJob(spec, appx.NewJob(name, fn), opts...)
+}
+
+// Every 按固定间隔添加任务, 间隔最小为1秒
+// 触发时间取决于每个副本的启动时间, 多副本需要 WithLock 时使用cron表达式, 保证各副本的触发时间相同
+func (s *Scheduler) Every(interval time.Duration, name string, fn appx.JobFunc, opts ...JobOptionFunc) (cron.EntryID, error) {
+	return s.schedule(cron.Every(interval), appx.NewJob(name, fn), opts...)
+}
+
+// Remove 移除任务
+func (s *Scheduler) Remove(id cron.EntryID) {
+	s.cron.Remove(id)
+}
+
+// Start 开始调度, 不阻塞
+func (s *Scheduler) Start() {
+	s.cron.Start()
+}
+
+// Stop 停止调度, 返回的context在正在执行的任务都结束后关闭
+func (s *Scheduler) Stop() context.Context {
+	return s.cron.Stop()
+}
+
+func (s *Scheduler) schedule(schedule cron.Schedule, job *appx.Job, opts ...JobOptionFunc) (cron.EntryID, error) {
+	if job == nil || job.Run == nil {
+		return 0, errors.New("cronx: job is nil")
+	}
+	o := JobOptions{LockTTL: defaultLockTTL}
+	for _, f := range opts {
+		f(&o)
+	}
+	if o.Lock && s.opts.Rdb == nil {
+		return 0, fmt.Errorf("cronx: job %s needs lock but redis is not set", job.Name)
+	}
+
+	ts := &tickSchedule{Schedule: schedule}
+	var cj cron.Job = cron.FuncJob(func() {
+		s.run(job, o, ts.tick(time.Now()))
+	})
+	if o.SkipIfRunning {
+		cj = cron.NewChain(cron.SkipIfStillRunning(cronLogger{})).Then(cj)
+	}
+	return s.cron.Schedule(ts, cj), nil
+}
+
+// run 执行一次任务, 需要锁时按触发时间加锁, 抢不到锁直接跳过
+func (s *Scheduler) run(job *appx.Job, o JobOptions, tick time.Time) {
+	if o.Lock {
+		key := s.opts.LockPrefix + job.Name + ":" + strconv.FormatInt(tick.Unix(), 10)
+		lock := utils.NewRedisLock(s.opts.Rdb, key, utils.WithLockTTL(o.LockTTL), utils.WithoutWatchdog())
+		ok, err := lock.TryLock(context.Background())
+		if err != nil {
+			logx.Info("cronx job %s skipped, lock not acquired: %s", job.Name, err.Error())
+			return
+		}
+		if !ok {
+			logx.Info("cronx job %s skipped, lock is held by another replica", job.Name)
+			return
+		}
+	}
+	job.Execute(context.Background(), "")
+}
+
+// tickSchedule 记录cron计算出的触发时间, 任务执行时用来获取本次的触发时间
+// cron在启动任务后才计算下一次时间, 所以任务开始时记录的最近两次时间中不晚于当前时间的就是本次触发时间
+type tickSchedule struct {
+	cron.Schedule
+	mu         sync.Mutex
+	prev, next time.Time
+}
+
+func (s *tickSchedule) Next(t time.Time) time.Time {
+	next := s.Schedule.Next(t)
+	s.mu.Lock()
+	s.prev, s.next = s.next, next
+	s.mu.Unlock()
+	return next
+}
+
+// tick 本次触发时间, 找不到时使用now
+func (s *tickSchedule) tick(now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.next.IsZero() && !s.next.After(now) {
+		return s.next
+	}
+	if !s.prev.IsZero() && !s.prev.After(now) {
+		return s.prev
+	}
+	return now
+}
+
+// cronLogger 将cron的错误日志写入logx, 与cron默认的logger一样忽略调度过程的info日志
+type cronLogger struct{}
+
+func (cronLogger) Info(msg string, keysAndValues ...interface{}) {}
+
+func (cronLogger) Error(err error, msg string, keysAndValues ...interface{}) {
+	logx.Error("cronx %s %v, err: %v", msg, keysAndValues, err)
+}
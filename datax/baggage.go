@@ -0,0 +1,101 @@
+package datax
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+const (
+	BaggageTenantId   = "tenant_id"   // 租户id
+	BaggageTrafficTag = "traffic_tag" // 流量标记, 用于灰度和泳道
+)
+
+// baggage 需要跨进程传递的key, 发送请求时作为header/metadata发送, 收到请求时写回context
+// key为context中的key, header为传递时使用的header名称, 统一使用小写以兼容grpc metadata
+type baggage struct {
+	key    string
+	header string
+}
+
+var (
+	baggageLock sync.RWMutex
+	baggages    = []baggage{
+		{key: BaggageTenantId, header: "x-tenant-id"},
+		{key: BaggageTrafficTag, header: "x-huayu-traffic-tag"},
+	}
+)
+
+// RegisterBaggage 将key标记为baggage, header为空时使用 x-key(下划线替换为中划线)
+// 重复注册同一个key会覆盖header
+func RegisterBaggage(key, header string) {
+	if key == "" {
+		return
+	}
+	if header == "" {
+		header = "x-" + strings.ReplaceAll(key, "_", "-")
+	}
+	header = strings.ToLower(header)
+
+	baggageLock.Lock()
+	defer baggageLock.Unlock()
+	for i := range baggages {
+		if baggages[i].key == key {
+			baggages[i].header = header
+			return
+		}
+	}
+	baggages = append(baggages, baggage{key: key, header: header})
+}
+
+// BaggageKeys 获取已注册的baggage, 返回 key->header
+func BaggageKeys() map[string]string {
+	baggageLock.RLock()
+	defer baggageLock.RUnlock()
+	keys := make(map[string]string, len(baggages))
+	for _, b := range baggages {
+		keys[b.key] = b.header
+	}
+	return keys
+}
+
+func listBaggage() []baggage {
+	baggageLock.RLock()
+	defer baggageLock.RUnlock()
+	return append([]baggage(nil), baggages...)
+}
+
+// GetBaggage 从context中取出需要传递的值, 返回 header->value, 没有值的key不返回
+// 通过 ctx.Value(key) 获取, 适用于 gin.Context、appx.Context、grpcx.GrpcContext 以及由它们派生的context
+func GetBaggage(ctx context.Context) map[string]string {
+	result := make(map[string]string)
+	if ctx == nil {
+		return result
+	}
+	for _, b := range listBaggage() {
+		val := ctx.Value(b.key)
+		if val == nil {
+			continue
+		}
+		if s, err := ToStringE(val); err == nil && s != "" {
+			result[b.header] = s
+		}
+	}
+	return result
+}
+
+// InjectBaggage 将context中的baggage通过set写入header/metadata
+func InjectBaggage(ctx context.Context, set func(header, value string)) {
+	for header, value := range GetBaggage(ctx) {
+		set(header, value)
+	}
+}
+
+// ExtractBaggage 通过get从收到的header/metadata中读取baggage并写回dc, 空值忽略
+func ExtractBaggage(dc DataContext, get func(header string) string) {
+	for _, b := range listBaggage() {
+		if value := get(b.header); value != "" {
+			dc.Set(b.key, value)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package datax
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+const timeFormat = "2006-01-02 15:04:05"
+
+var (
+	ErrKeyNotExists = errors.New("datax: key does not exist")
+	ErrTypeMismatch = errors.New("datax: type mismatch")
+)
+
+// 以下 GetXxxE 方法适用于任意 DataContext(gin.Context、MemoryContext等)
+// 与 DataContext 中的 GetXxx 不同, key不存在或类型无法转换时返回error而不是零值
+// 数值类型之间、数值与字符串之间会自动转换, 转换会丢失精度或溢出时返回error
+
+// GetE 获取key对应的值, key不存在时返回 ErrKeyNotExists
+func GetE(dc DataContext, key string) (interface{}, error) {
+	val, ok := dc.Get(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotExists, key)
+	}
+	return val, nil
+}
+
+// GetStringE 获取string
+func GetStringE(dc DataContext, key string) (string, error) {
+	val, err := GetE(dc, key)
+	if err != nil {
+		return "", err
+	}
+	return ToStringE(val)
+}
+
+// GetIntE 获取int
+func GetIntE(dc DataContext, key string) (int, error) {
+	val, err := GetE(dc, key)
+	if err != nil {
+		return 0, err
+	}
+	return ToIntE(val)
+}
+
+// GetInt64E 获取int64
+func GetInt64E(dc DataContext, key string) (int64, error) {
+	val, err := GetE(dc, key)
+	if err != nil {
+		return 0, err
+	}
+	return ToInt64E(val)
+}
+
+// GetFloat64E 获取float64
+func GetFloat64E(dc DataContext, key string) (float64, error) {
+	val, err := GetE(dc, key)
+	if err != nil {
+		return 0, err
+	}
+	return ToFloat64E(val)
+}
+
+// GetBoolE 获取bool
+func GetBoolE(dc DataContext, key string) (bool, error) {
+	val, err := GetE(dc, key)
+	if err != nil {
+		return false, err
+	}
+	return ToBoolE(val)
+}
+
+// GetDurationE 获取time.Duration
+func GetDurationE(dc DataContext, key string) (time.Duration, error) {
+	val, err := GetE(dc, key)
+	if err != nil {
+		return 0, err
+	}
+	return ToDurationE(val)
+}
+
+// GetTimeE 获取time.Time
+func GetTimeE(dc DataContext, key string) (time.Time, error) {
+	val, err := GetE(dc, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return ToTimeE(val)
+}
+
+func mismatch(v interface{}, to string) error {
+	return fmt.Errorf("%w: %T(%v) to %s", ErrTypeMismatch, v, v, to)
+}
+
+// ToStringE 转换为string, 支持字符串、[]byte、数值、bool和fmt.Stringer
+func ToStringE(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case string:
+		return t, nil
+	case []byte:
+		return string(t), nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case int:
+		return strconv.Itoa(t), nil
+	case int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprintf("%d", t), nil
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	case json.Number:
+		return t.String(), nil
+	case fmt.Stringer:
+		return t.String(), nil
+	}
+	return "", mismatch(v, "string")
+}
+
+// ToInt64E 转换为int64, 浮点数必须是整数, 字符串必须是十进制整数
+func ToInt64E(v interface{}) (int64, error) {
+	switch t := v.(type) {
+	case int:
+		return int64(t), nil
+	case int8:
+		return int64(t), nil
+	case int16:
+		return int64(t), nil
+	case int32:
+		return int64(t), nil
+	case int64:
+		return t, nil
+	case uint:
+		return uintToInt64(uint64(t), v)
+	case uint8:
+		return int64(t), nil
+	case uint16:
+		return int64(t), nil
+	case uint32:
+		return int64(t), nil
+	case uint64:
+		return uintToInt64(t, v)
+	case float32:
+		return floatToInt64(float64(t), v)
+	case float64:
+		return floatToInt64(t, v)
+	case time.Duration:
+		return int64(t), nil
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i, nil
+		}
+	case string:
+		if i, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return i, nil
+		}
+	}
+	return 0, mismatch(v, "int64")
+}
+
+func uintToInt64(u uint64, v interface{}) (int64, error) {
+	if u > math.MaxInt64 {
+		return 0, mismatch(v, "int64")
+	}
+	return int64(u), nil
+}
+
+func floatToInt64(f float64, v interface{}) (int64, error) {
+	if f != math.Trunc(f) || f >= math.MaxInt64 || f < math.MinInt64 {
+		return 0, mismatch(v, "int64")
+	}
+	return int64(f), nil
+}
+
+// ToIntE 转换为int
+func ToIntE(v interface{}) (int, error) {
+	i, err := ToInt64E(v)
+	if err != nil {
+		return 0, mismatch(v, "int")
+	}
+	if int64(int(i)) != i {
+		return 0, mismatch(v, "int")
+	}
+	return int(i), nil
+}
+
+// ToFloat64E 转换为float64
+func ToFloat64E(v interface{}) (float64, error) {
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case float32:
+		return float64(t), nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		i, err := ToInt64E(t)
+		if err != nil {
+			return 0, mismatch(v, "float64")
+		}
+		return float64(i), nil
+	case json.Number:
+		if f, err := t.Float64(); err == nil {
+			return f, nil
+		}
+	case string:
+		if f, err := strconv.ParseFloat(t, 64); err == nil {
+			return f, nil
+		}
+	}
+	return 0, mismatch(v, "float64")
+}
+
+// ToBoolE 转换为bool, 字符串支持 1/0/t/f/true/false, 数值非0为true
+func ToBoolE(v interface{}) (bool, error) {
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case string:
+		if b, err := strconv.ParseBool(t); err == nil {
+			return b, nil
+		}
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		i, err := ToInt64E(t)
+		if err == nil {
+			return i != 0, nil
+		}
+	}
+	return false, mismatch(v, "bool")
+}
+
+// ToDurationE 转换为time.Duration, 字符串支持 "1s" 这样的格式, 整数按纳秒处理
+func ToDurationE(v interface{}) (time.Duration, error) {
+	switch t := v.(type) {
+	case time.Duration:
+		return t, nil
+	case string:
+		if d, err := time.ParseDuration(t); err == nil {
+			return d, nil
+		}
+		if i, err := strconv.ParseInt(t, 10, 64); err == nil {
+			return time.Duration(i), nil
+		}
+	default:
+		if i, err := ToInt64E(t); err == nil {
+			return time.Duration(i), nil
+		}
+	}
+	return 0, mismatch(v, "time.Duration")
+}
+
+// ToTimeE 转换为time.Time, 字符串支持RFC3339和 "2006-01-02 15:04:05"(本地时区), 整数按秒级时间戳处理
+func ToTimeE(v interface{}) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		if tm, err := time.Parse(time.RFC3339, t); err == nil {
+			return tm, nil
+		}
+		if tm, err := time.ParseInLocation(timeFormat, t, time.Local); err == nil {
+			return tm, nil
+		}
+	case int, int32, int64, uint, uint32, uint64, json.Number:
+		if i, err := ToInt64E(t); err == nil {
+			return time.Unix(i, 0), nil
+		}
+	}
+	return time.Time{}, mismatch(v, "time.Time")
+}
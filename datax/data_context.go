@@ -2,6 +2,8 @@ package datax
 
 import (
 	"github.com/gin-gonic/gin"
+	"reflect"
+	"sync"
 	"time"
 )
 
@@ -28,9 +30,41 @@ var (
 	_ DataContext = &MemoryContext{}
 )
 
+// getOrSetLocks 不支持 GetOrSet 的 DataContext(如 gin.Context)按地址分片加锁, 不同请求之间基本不会互相等待
+var getOrSetLocks [64]sync.Mutex
+
+// GetOrSet 获取key, 不存在或为nil时调用create创建并保存, 同一个 DataContext 并发调用时只会创建一次
+// MemoryContext 及嵌入它的 appx.Context、grpcx.GrpcContext 在自己的锁内完成, create中不能再访问dc
+func GetOrSet(dc DataContext, key string, create func() interface{}) interface{} {
+	if g, ok := dc.(interface {
+		GetOrSet(key string, create func() interface{}) interface{}
+	}); ok {
+		return g.GetOrSet(key, create)
+	}
+	if val, ok := dc.Get(key); ok && val != nil {
+		return val
+	}
+	var idx uintptr
+	if rv := reflect.ValueOf(dc); rv.Kind() == reflect.Ptr {
+		idx = rv.Pointer() >> 4 % uintptr(len(getOrSetLocks))
+	}
+	mu := &getOrSetLocks[idx]
+	mu.Lock()
+	defer mu.Unlock()
+	if val, ok := dc.Get(key); ok && val != nil {
+		return val
+	}
+	val := create()
+	dc.Set(key, val)
+	return val
+}
+
 // MemoryContext gstore data tor memory
+// MemoryContext 可以并发读写, 子作用域可以读到父作用域的数据, 写入只影响自己
 type MemoryContext struct {
-	data map[string]interface{}
+	mu     sync.RWMutex
+	data   map[string]interface{}
+	parent *MemoryContext
 }
 
 // NewMemoryContext new one
@@ -40,22 +74,89 @@ func NewMemoryContext() *MemoryContext {
 	}
 }
 
+// NewScope 创建子作用域, 读取时先查自己再查父作用域, 写入和删除只影响子作用域
+// 适合把请求数据传给goroutine使用, goroutine写入的数据不会污染请求的context
+func (c *MemoryContext) NewScope() *MemoryContext {
+	return &MemoryContext{
+		data:   map[string]interface{}{},
+		parent: c,
+	}
+}
+
+// Parent 获取父作用域, 顶层作用域返回nil
+func (c *MemoryContext) Parent() *MemoryContext {
+	return c.parent
+}
+
 // Set is used to gstore a new key/value pair exclusively for this contextx.
 // It also lazy initializes  c.data if it was not used previously.
 func (c *MemoryContext) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.data == nil {
 		c.data = make(map[string]interface{})
 	}
 	c.data[key] = value
 }
 
+// GetOrSet 获取key, 不存在或为nil时调用create创建并保存到当前作用域, 并发调用时只会创建一次
+// create在锁内执行, 不能再访问c
+func (c *MemoryContext) GetOrSet(key string, create func() interface{}) interface{} {
+	if val, ok := c.Get(key); ok && val != nil {
+		return val
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if val, ok := c.data[key]; ok && val != nil {
+		return val
+	}
+	if c.data == nil {
+		c.data = make(map[string]interface{})
+	}
+	val := create()
+	c.data[key] = val
+	return val
+}
+
+// Delete 删除当前作用域中的key, 不影响父作用域
+func (c *MemoryContext) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, key)
+}
+
 // Get returns the value for the given key, ie: (value, true).
 // If the value does not exists it returns (nil, false)
+// 当前作用域不存在时会继续查找父作用域
 func (c *MemoryContext) Get(key string) (value interface{}, exists bool) {
-	value, exists = c.data[key]
+	for scope := c; scope != nil; scope = scope.parent {
+		scope.mu.RLock()
+		value, exists = scope.data[key]
+		scope.mu.RUnlock()
+		if exists {
+			return
+		}
+	}
 	return
 }
 
+// Keys 获取当前作用域及父作用域中所有的key
+func (c *MemoryContext) Keys() []string {
+	seen := make(map[string]struct{})
+	var keys []string
+	for scope := c; scope != nil; scope = scope.parent {
+		scope.mu.RLock()
+		for k := range scope.data {
+			if _, ok := seen[k]; !ok {
+				seen[k] = struct{}{}
+				keys = append(keys, k)
+			}
+		}
+		scope.mu.RUnlock()
+	}
+	return keys
+}
+
 // MustGet returns the value for the given key if it exists, otherwise it panics.
 func (c *MemoryContext) MustGet(key string) interface{} {
 	if value, exists := c.Get(key); exists {
@@ -0,0 +1,302 @@
+package datax
+
+import (
+	"fmt"
+	"golang.org/x/sync/singleflight"
+	"sync"
+	"time"
+)
+
+const (
+	loaderCacheKey       = "__datax_loader_cache"
+	defaultBatchWait     = 2 * time.Millisecond // 批量加载等待其他key的时间
+	defaultBatchMaxCount = 100                  // 单次批量加载的最大key数量
+)
+
+// LoaderFunc 加载单个key
+type LoaderFunc func() (interface{}, error)
+
+// BatchFunc 批量加载, 返回key对应的值, 不存在的key不需要返回
+type BatchFunc func(keys []string) (map[string]interface{}, error)
+
+// LoaderCache 请求级别的加载缓存, 存放在请求的 DataContext 中, 请求结束后释放
+// 同一个请求内相同key只会加载一次, 并发加载同一个key时只有一个会真正执行
+// BatchLoader 的数据按加载器名称单独保存, 不会与 GetOrLoad 的key冲突
+type LoaderCache struct {
+	mu       sync.Mutex
+	group    singleflight.Group
+	data     map[string]interface{}
+	batched  map[string]map[string]interface{} // 加载器名称 => key => 值
+	batchers map[string]*batcher
+}
+
+// GetLoaderCache 获取请求的 LoaderCache, 不存在时创建
+func GetLoaderCache(dc DataContext) *LoaderCache {
+	if lc, ok := loaderCache(dc); ok {
+		return lc
+	}
+	val := GetOrSet(dc, loaderCacheKey, func() interface{} {
+		return newLoaderCache()
+	})
+	if lc, ok := val.(*LoaderCache); ok && lc != nil {
+		return lc
+	}
+	// key被写入了其他类型的值
+	lc := newLoaderCache()
+	dc.Set(loaderCacheKey, lc)
+	return lc
+}
+
+func newLoaderCache() *LoaderCache {
+	return &LoaderCache{
+		data:     make(map[string]interface{}),
+		batched:  make(map[string]map[string]interface{}),
+		batchers: make(map[string]*batcher),
+	}
+}
+
+// ReleaseLoaderCache 释放请求的 LoaderCache, 由httpx和grpcx的拦截器在请求结束时调用
+func ReleaseLoaderCache(dc DataContext) {
+	lc, ok := loaderCache(dc)
+	if !ok {
+		return
+	}
+	lc.mu.Lock()
+	lc.data = make(map[string]interface{})
+	lc.batched = make(map[string]map[string]interface{})
+	lc.batchers = make(map[string]*batcher)
+	lc.mu.Unlock()
+	dc.Set(loaderCacheKey, nil)
+}
+
+func loaderCache(dc DataContext) (*LoaderCache, bool) {
+	val, ok := dc.Get(loaderCacheKey)
+	if !ok || val == nil {
+		return nil, false
+	}
+	lc, ok := val.(*LoaderCache)
+	return lc, ok && lc != nil
+}
+
+// GetOrLoad 从请求缓存中获取key, 不存在时调用loader加载, 加载失败不缓存
+func GetOrLoad(dc DataContext, key string, loader LoaderFunc) (interface{}, error) {
+	return GetLoaderCache(dc).GetOrLoad(key, loader)
+}
+
+// GetOrLoad 获取key, 不存在时调用loader加载
+func (lc *LoaderCache) GetOrLoad(key string, loader LoaderFunc) (interface{}, error) {
+	if val, ok := lc.get(key); ok {
+		return val, nil
+	}
+
+	val, err, _ := lc.group.Do(key, func() (interface{}, error) {
+		if val, ok := lc.get(key); ok {
+			return val, nil
+		}
+		val, err := loader()
+		if err != nil {
+			return nil, err
+		}
+		lc.set(key, val)
+		return val, nil
+	})
+	return val, err
+}
+
+// Forget 删除缓存的key, 数据被修改后调用
+func (lc *LoaderCache) Forget(key string) {
+	lc.mu.Lock()
+	delete(lc.data, key)
+	lc.mu.Unlock()
+}
+
+func (lc *LoaderCache) get(key string) (val interface{}, ok bool) {
+	lc.mu.Lock()
+	val, ok = lc.data[key]
+	lc.mu.Unlock()
+	return
+}
+
+func (lc *LoaderCache) set(key string, val interface{}) {
+	lc.mu.Lock()
+	lc.data[key] = val
+	lc.mu.Unlock()
+}
+
+func (lc *LoaderCache) getBatched(name, key string) (val interface{}, ok bool) {
+	lc.mu.Lock()
+	val, ok = lc.batched[name][key]
+	lc.mu.Unlock()
+	return
+}
+
+func (lc *LoaderCache) setBatched(name string, result map[string]interface{}) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	m, ok := lc.batched[name]
+	if !ok {
+		m = make(map[string]interface{}, len(result))
+		lc.batched[name] = m
+	}
+	for k, v := range result {
+		m[k] = v
+	}
+}
+
+// BatchLoader 批量加载器(DataLoader), 同一个请求内短时间内的多次Load会合并成一次BatchFunc调用
+// BatchLoader 本身不保存数据, 可以定义成全局变量在多个请求间复用
+type BatchLoader struct {
+	Name     string        // 加载器名称, 同一个请求内不同的加载器名称不能相同
+	Fn       BatchFunc     // 批量加载函数
+	Wait     time.Duration // 等待其他key的时间, 默认2ms
+	MaxBatch int           // 单次最多加载的key数量, 默认100
+}
+
+// NewBatchLoader 创建批量加载器
+func NewBatchLoader(name string, fn BatchFunc) *BatchLoader {
+	return &BatchLoader{
+		Name:     name,
+		Fn:       fn,
+		Wait:     defaultBatchWait,
+		MaxBatch: defaultBatchMaxCount,
+	}
+}
+
+// Load 加载单个key, key不存在时返回 ErrKeyNotExists
+func (bl *BatchLoader) Load(dc DataContext, key string) (interface{}, error) {
+	lc := GetLoaderCache(dc)
+	if val, ok := lc.getBatched(bl.Name, key); ok {
+		return val, nil
+	}
+
+	b := lc.batcher(bl).add(key)
+	<-b.done
+	if b.err != nil {
+		return nil, b.err
+	}
+	val, ok := b.result[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotExists, key)
+	}
+	return val, nil
+}
+
+// LoadMany 加载多个key, 返回存在的key对应的值
+func (bl *BatchLoader) LoadMany(dc DataContext, keys []string) (map[string]interface{}, error) {
+	lc := GetLoaderCache(dc)
+	result := make(map[string]interface{}, len(keys))
+	var pending []*batch
+	for _, key := range keys {
+		if val, ok := lc.getBatched(bl.Name, key); ok {
+			result[key] = val
+			continue
+		}
+		pending = append(pending, lc.batcher(bl).add(key))
+	}
+
+	for _, b := range pending {
+		<-b.done
+		if b.err != nil {
+			return nil, b.err
+		}
+	}
+	for _, b := range pending {
+		for _, key := range keys {
+			if val, ok := b.result[key]; ok {
+				result[key] = val
+			}
+		}
+	}
+	return result, nil
+}
+
+func (lc *LoaderCache) batcher(bl *BatchLoader) *batcher {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	b, ok := lc.batchers[bl.Name]
+	if !ok {
+		b = &batcher{loader: bl, cache: lc}
+		lc.batchers[bl.Name] = b
+	}
+	return b
+}
+
+// batcher 收集同一个加载器在等待时间内的key
+type batcher struct {
+	mu      sync.Mutex
+	loader  *BatchLoader
+	cache   *LoaderCache
+	current *batch
+}
+
+// batch 一次批量加载
+type batch struct {
+	keys   []string
+	seen   map[string]struct{}
+	done   chan struct{}
+	result map[string]interface{}
+	err    error
+}
+
+// add 将key加入当前批次, 批次满了立即加载, 否则等待 Wait 后加载
+func (b *batcher) add(key string) *batch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cur := b.current
+	if cur == nil {
+		cur = &batch{
+			seen: make(map[string]struct{}),
+			done: make(chan struct{}),
+		}
+		b.current = cur
+		wait := b.loader.Wait
+		if wait <= 0 {
+			wait = defaultBatchWait
+		}
+		time.AfterFunc(wait, func() {
+			b.dispatch(cur)
+		})
+	}
+	if _, ok := cur.seen[key]; !ok {
+		cur.seen[key] = struct{}{}
+		cur.keys = append(cur.keys, key)
+	}
+
+	max := b.loader.MaxBatch
+	if max <= 0 {
+		max = defaultBatchMaxCount
+	}
+	if len(cur.keys) >= max {
+		b.current = nil
+		go b.run(cur)
+	}
+	return cur
+}
+
+// dispatch 等待时间到了之后加载, 已经因为批次满了而加载的忽略
+func (b *batcher) dispatch(cur *batch) {
+	b.mu.Lock()
+	if b.current != cur {
+		b.mu.Unlock()
+		return
+	}
+	b.current = nil
+	b.mu.Unlock()
+	b.run(cur)
+}
+
+func (b *batcher) run(cur *batch) {
+	defer close(cur.done)
+	defer func() {
+		if r := recover(); r != nil {
+			cur.err = fmt.Errorf("datax: batch loader %s panic: %v", b.loader.Name, r)
+		}
+	}()
+
+	cur.result, cur.err = b.loader.Fn(cur.keys)
+	if cur.err != nil {
+		return
+	}
+	b.cache.setBatched(b.loader.Name, cur.result)
+}
@@ -0,0 +1,307 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/laydong/toolpkg/logx"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
+	"reflect"
+)
+
+const (
+	auditMaxRows = 100 // 一条sql最多记录的行数
+	auditOldKey  = "audit:old"
+	auditLogKey  = "audit:log" // after_* 中收集的变更, 提交后写入
+
+	AuditCreate     = "create"
+	AuditUpdate     = "update"
+	AuditDelete     = "delete"
+	AuditSoftDelete = "soft_delete"
+)
+
+// AuditUserKey 审计日志从ctx中读取用户id的key, 登录中间件需要写入 gin.Context 或 appx.Context
+var AuditUserKey = "user_id"
+
+// AuditUser 获取ctx中的用户id, 可以替换为从token等读取
+var AuditUser = func(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if v := ctx.Value(AuditUserKey); v != nil {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// auditRecord 一行数据的变更
+type auditRecord struct {
+	PrimaryKey interface{}            `json:"primary_key"`
+	Old        map[string]interface{} `json:"old,omitempty"`
+	New        map[string]interface{} `json:"new,omitempty"`
+}
+
+// auditLog 一条sql收集到的变更
+type auditLog struct {
+	action  string
+	records []auditRecord
+}
+
+// auditor 记录 Create、Update、Delete 的变更, 不记录 Exec 执行的sql
+// 更新和删除前按相同的条件查询旧值, 只记录前 auditMaxRows 行
+// 变更在 gorm:commit_or_rollback_transaction 之后写入, 语句失败回滚时不记录
+type auditor struct {
+	name   string
+	tables map[string]bool
+}
+
+func registerAuditCallbacks(ins *dbInstance) {
+	a := &auditor{name: ins.conf.Name}
+	if len(ins.conf.AuditTables) > 0 {
+		a.tables = make(map[string]bool, len(ins.conf.AuditTables))
+		for _, t := range ins.conf.AuditTables {
+			a.tables[t] = true
+		}
+	}
+	db := ins.db
+	db.Callback().Create().After("gorm:create").Register("audit:after_create", a.afterCreate)
+	db.Callback().Create().After("gorm:commit_or_rollback_transaction").Register("audit:write", a.write)
+	db.Callback().Update().Before("gorm:update").Register("audit:before_update", a.loadOld)
+	db.Callback().Update().After("gorm:update").Register("audit:after_update", a.afterUpdate)
+	db.Callback().Update().After("gorm:commit_or_rollback_transaction").Register("audit:write", a.write)
+	db.Callback().Delete().Before("gorm:delete").Register("audit:before_delete", a.loadOld)
+	db.Callback().Delete().After("gorm:delete").Register("audit:after_delete", a.afterDelete)
+	db.Callback().Delete().After("gorm:commit_or_rollback_transaction").Register("audit:write", a.write)
+}
+
+func (a *auditor) enabled(db *gorm.DB) bool {
+	if db.Error != nil || db.DryRun || db.Statement.Table == "" {
+		return false
+	}
+	return a.tables == nil || a.tables[db.Statement.Table]
+}
+
+// loadOld 在主库查询将要更新或删除的行, 事务中使用同一个事务
+func (a *auditor) loadOld(db *gorm.DB) {
+	if !a.enabled(db) {
+		return
+	}
+	exprs := a.conditions(db)
+	if len(exprs) == 0 {
+		return
+	}
+
+	tx := db.Session(&gorm.Session{NewDB: true}).Clauses(dbresolver.Write)
+	if sch := db.Statement.Schema; sch != nil {
+		tx = tx.Model(reflect.New(sch.ModelType).Interface())
+	} else {
+		tx = tx.Table(db.Statement.Table)
+	}
+	if db.Statement.Unscoped {
+		tx = tx.Unscoped()
+	}
+	var rows []map[string]interface{}
+	if err := tx.Clauses(clause.Where{Exprs: exprs}).Limit(auditMaxRows).Find(&rows).Error; err != nil {
+		return
+	}
+	db.InstanceSet(auditOldKey, rows)
+}
+
+// conditions 更新和删除的条件, gorm在执行时才会按模型的主键生成条件, 这里按同样的规则补充
+func (a *auditor) conditions(db *gorm.DB) []clause.Expression {
+	var exprs []clause.Expression
+	if c, ok := db.Statement.Clauses["WHERE"]; ok {
+		if where, ok := c.Expression.(clause.Where); ok {
+			exprs = append(exprs, where.Exprs...)
+		}
+	}
+	sch := db.Statement.Schema
+	if sch == nil || !db.Statement.ReflectValue.IsValid() {
+		return exprs
+	}
+	ctx := db.Statement.Context
+	rv := reflect.Indirect(db.Statement.ReflectValue)
+	switch rv.Kind() {
+	case reflect.Struct:
+		for _, f := range sch.PrimaryFields {
+			if v, zero := f.ValueOf(ctx, rv); !zero {
+				exprs = append(exprs, clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: f.DBName}, Value: v})
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if sch.PrioritizedPrimaryField == nil {
+			break
+		}
+		var values []interface{}
+		for i := 0; i < rv.Len(); i++ {
+			if v, zero := sch.PrioritizedPrimaryField.ValueOf(ctx, reflect.Indirect(rv.Index(i))); !zero {
+				values = append(values, v)
+			}
+		}
+		if len(values) > 0 {
+			exprs = append(exprs, clause.IN{Column: clause.Column{Table: clause.CurrentTable, Name: sch.PrioritizedPrimaryField.DBName}, Values: values})
+		}
+	}
+	return exprs
+}
+
+func (a *auditor) oldRows(db *gorm.DB) []map[string]interface{} {
+	val, ok := db.InstanceGet(auditOldKey)
+	if !ok {
+		return nil
+	}
+	rows, _ := val.([]map[string]interface{})
+	return rows
+}
+
+func (a *auditor) afterCreate(db *gorm.DB) {
+	if !a.enabled(db) || db.RowsAffected == 0 {
+		return
+	}
+	rv := reflect.Indirect(db.Statement.ReflectValue)
+	var records []auditRecord
+	add := func(v reflect.Value) {
+		row := a.rowOf(db, reflect.Indirect(v))
+		records = append(records, auditRecord{PrimaryKey: a.primaryKey(db, row), New: row})
+	}
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len() && i < auditMaxRows; i++ {
+			add(rv.Index(i))
+		}
+	default:
+		add(rv)
+	}
+	a.collect(db, AuditCreate, records)
+}
+
+func (a *auditor) afterUpdate(db *gorm.DB) {
+	rows := a.oldRows(db)
+	if !a.enabled(db) || db.RowsAffected == 0 || len(rows) == 0 {
+		return
+	}
+	values := map[string]interface{}{}
+	if c, ok := db.Statement.Clauses["SET"]; ok {
+		if set, ok := c.Expression.(clause.Set); ok {
+			for _, assign := range set {
+				if expr, ok := assign.Value.(clause.Expr); ok {
+					values[assign.Column.Name] = expr.SQL
+				} else {
+					values[assign.Column.Name] = assign.Value
+				}
+			}
+		}
+	}
+
+	records := make([]auditRecord, 0, len(rows))
+	for _, row := range rows {
+		r := auditRecord{PrimaryKey: a.primaryKey(db, row), Old: map[string]interface{}{}, New: map[string]interface{}{}}
+		for col, v := range values {
+			if fmt.Sprint(row[col]) == fmt.Sprint(v) {
+				continue
+			}
+			r.Old[col] = row[col]
+			r.New[col] = v
+		}
+		if len(r.New) > 0 {
+			records = append(records, r)
+		}
+	}
+	a.collect(db, AuditUpdate, records)
+}
+
+func (a *auditor) afterDelete(db *gorm.DB) {
+	rows := a.oldRows(db)
+	if !a.enabled(db) || db.RowsAffected == 0 || len(rows) == 0 {
+		return
+	}
+	action := AuditDelete
+	if sch := db.Statement.Schema; sch != nil && len(sch.DeleteClauses) > 0 && !db.Statement.Unscoped {
+		action = AuditSoftDelete
+	}
+	records := make([]auditRecord, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, auditRecord{PrimaryKey: a.primaryKey(db, row), Old: row})
+	}
+	a.collect(db, action, records)
+}
+
+// rowOf 模型的列和值, 没有模型时(如 Create(map))使用map的值
+func (a *auditor) rowOf(db *gorm.DB, v reflect.Value) map[string]interface{} {
+	row := map[string]interface{}{}
+	if sch := db.Statement.Schema; sch != nil && v.Kind() == reflect.Struct {
+		for _, f := range sch.Fields {
+			if f.DBName == "" {
+				continue
+			}
+			row[f.DBName], _ = f.ValueOf(db.Statement.Context, v)
+		}
+		return row
+	}
+	if v.Kind() == reflect.Map {
+		for _, k := range v.MapKeys() {
+			row[fmt.Sprint(k.Interface())] = v.MapIndex(k).Interface()
+		}
+	}
+	return row
+}
+
+func (a *auditor) primaryKey(db *gorm.DB, row map[string]interface{}) interface{} {
+	sch := db.Statement.Schema
+	if sch == nil || len(sch.PrimaryFields) == 0 {
+		return row["id"]
+	}
+	if len(sch.PrimaryFields) == 1 {
+		return row[sch.PrimaryFields[0].DBName]
+	}
+	pk := make(map[string]interface{}, len(sch.PrimaryFields))
+	for _, f := range sch.PrimaryFields {
+		pk[f.DBName] = row[f.DBName]
+	}
+	return pk
+}
+
+// collect 保存变更, 等语句的事务结束后由 write 写入
+func (a *auditor) collect(db *gorm.DB, action string, records []auditRecord) {
+	if len(records) == 0 {
+		return
+	}
+	db.InstanceSet(auditLogKey, auditLog{action: action, records: records})
+}
+
+// write 语句成功时脱敏后写入审计日志, 在 Transaction 中时事务提交后写入
+func (a *auditor) write(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+	val, ok := db.InstanceGet(auditLogKey)
+	if !ok {
+		return
+	}
+	entry := val.(auditLog)
+	action, records := entry.action, entry.records
+	for _, r := range records {
+		maskRow(r.Old)
+		maskRow(r.New)
+	}
+	ctx := db.Statement.Context
+	table, rowsAffected := db.Statement.Table, db.RowsAffected
+	AfterCommit(ctx, func() {
+		logx.Audit(logx.RequestIdFromContext(ctx),
+			zap.String("database", a.name),
+			zap.String("table", table),
+			zap.String("action", action),
+			zap.String("user_id", AuditUser(ctx)),
+			zap.Int64("rows_affected", rowsAffected),
+			zap.Any("records", records),
+		)
+	}, a.name)
+}
+
+func maskRow(row map[string]interface{}) {
+	for col, v := range row {
+		row[col] = logx.MaskValue(col, v)
+	}
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// 过滤条件的比较方式
+const (
+	FilterEq     = "eq"      // =, 默认
+	FilterNe     = "ne"      // <>
+	FilterGt     = "gt"      // >
+	FilterGte    = "gte"     // >=
+	FilterLt     = "lt"      // <
+	FilterLte    = "lte"     // <=
+	FilterLike   = "like"    // LIKE %v%
+	FilterPrefix = "prefix"  // LIKE v%
+	FilterIn     = "in"      // IN, 字段为切片
+	FilterNotIn  = "not_in"  // NOT IN, 字段为切片
+	FilterNull   = "is_null" // 字段为bool, true为 IS NULL, false为 IS NOT NULL
+)
+
+var orderRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.]+(\s+(?i:asc|desc))?$`)
+
+// filterField 过滤结构体的一个字段
+type filterField struct {
+	index  []int
+	column string
+	op     string
+}
+
+var filterCache sync.Map // reflect.Type => []filterField
+
+// Filter 按结构体的 filter 标签生成查询条件, 用于 Scopes 和 Repository 的查询
+// 标签格式 `filter:"列名,比较方式"`, 列名为空时按gorm的命名规则由字段名生成, 比较方式默认 eq, "-" 忽略字段
+// 零值字段不生成条件, 需要按零值过滤时使用指针字段, 匿名结构体字段会展开
+//
+//	type UserFilter struct {
+//		Name   string   `filter:"name,like" form:"name"`
+//		Status *int     `filter:"status" form:"status"`
+//		Ids    []int64  `filter:"id,in" form:"ids"`
+//		Begin  int64    `filter:"created_at,gte" form:"begin"`
+//	}
+func Filter(filter interface{}) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if filter == nil {
+			return db
+		}
+		rv := reflect.ValueOf(filter)
+		for rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return db
+			}
+			rv = rv.Elem()
+		}
+		if rv.Kind() != reflect.Struct {
+			_ = db.AddError(fmt.Errorf("db: filter must be a struct, got %s", rv.Type()))
+			return db
+		}
+
+		fields, err := parseFilter(rv.Type(), db.NamingStrategy)
+		if err != nil {
+			_ = db.AddError(err)
+			return db
+		}
+		exprs := make([]clause.Expression, 0, len(fields))
+		for _, f := range fields {
+			if expr, ok := f.expr(rv.FieldByIndex(f.index)); ok {
+				exprs = append(exprs, expr)
+			}
+		}
+		if len(exprs) == 0 {
+			return db
+		}
+		return db.Where(clause.And(exprs...))
+	}
+}
+
+// OrderBy 按 "列名 [asc|desc], ..." 排序, 可以直接使用请求参数, 格式不正确时查询返回错误
+func OrderBy(order string) func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		order = strings.TrimSpace(order)
+		if order == "" {
+			return db
+		}
+		columns := make([]clause.OrderByColumn, 0, 2)
+		for _, item := range strings.Split(order, ",") {
+			item = strings.TrimSpace(item)
+			if !orderRegexp.MatchString(item) {
+				_ = db.AddError(fmt.Errorf("db: invalid order %s", item))
+				return db
+			}
+			parts := strings.Fields(item)
+			columns = append(columns, clause.OrderByColumn{
+				Column: filterColumn(parts[0]),
+				Desc:   len(parts) > 1 && strings.EqualFold(parts[1], "desc"),
+			})
+		}
+		return db.Clauses(clause.OrderBy{Columns: columns})
+	}
+}
+
+// WithDeleted 查询包含软删除的记录
+func WithDeleted() func(db *gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Unscoped()
+	}
+}
+
+func parseFilter(typ reflect.Type, namer schema.Namer) ([]filterField, error) {
+	if v, ok := filterCache.Load(typ); ok {
+		return v.([]filterField), nil
+	}
+
+	var fields []filterField
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		tag := sf.Tag.Get("filter")
+		if tag == "-" {
+			continue
+		}
+		if sf.Anonymous && tag == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				// 匿名指针字段为nil时 FieldByIndex 会panic, 只展开非指针的匿名结构体
+				if sf.Type.Kind() == reflect.Ptr {
+					return nil, fmt.Errorf("db: filter %s embedded pointer %s not supported", typ, sf.Name)
+				}
+				sub, err := parseFilter(ft, namer)
+				if err != nil {
+					return nil, err
+				}
+				for _, f := range sub {
+					f.index = append([]int{i}, f.index...)
+					fields = append(fields, f)
+				}
+				continue
+			}
+		}
+		if !sf.IsExported() {
+			continue
+		}
+
+		f := filterField{index: []int{i}, op: FilterEq}
+		name, op, _ := strings.Cut(tag, ",")
+		f.column = strings.TrimSpace(name)
+		if op = strings.TrimSpace(op); op != "" {
+			f.op = op
+		}
+		if f.column == "" {
+			f.column = namer.ColumnName("", sf.Name)
+		}
+		if !tableNameRegexp.MatchString(f.column) {
+			return nil, fmt.Errorf("db: filter %s.%s invalid column %s", typ, sf.Name, f.column)
+		}
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch f.op {
+		case FilterEq, FilterNe, FilterGt, FilterGte, FilterLt, FilterLte:
+		case FilterLike, FilterPrefix:
+			if ft.Kind() != reflect.String {
+				return nil, fmt.Errorf("db: filter %s.%s %s requires string", typ, sf.Name, f.op)
+			}
+		case FilterIn, FilterNotIn:
+			if ft.Kind() != reflect.Slice && ft.Kind() != reflect.Array {
+				return nil, fmt.Errorf("db: filter %s.%s %s requires slice", typ, sf.Name, f.op)
+			}
+		case FilterNull:
+			if ft.Kind() != reflect.Bool {
+				return nil, fmt.Errorf("db: filter %s.%s %s requires bool", typ, sf.Name, f.op)
+			}
+		default:
+			return nil, fmt.Errorf("db: filter %s.%s unknown op %s", typ, sf.Name, f.op)
+		}
+		fields = append(fields, f)
+	}
+
+	filterCache.Store(typ, fields)
+	return fields, nil
+}
+
+// expr 生成字段的查询条件, 零值和nil返回false
+func (f filterField) expr(v reflect.Value) (clause.Expression, bool) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, false
+		}
+		v = v.Elem()
+	} else if v.IsZero() {
+		return nil, false
+	}
+
+	col := filterColumn(f.column)
+	switch f.op {
+	case FilterNe:
+		return clause.Neq{Column: col, Value: v.Interface()}, true
+	case FilterGt:
+		return clause.Gt{Column: col, Value: v.Interface()}, true
+	case FilterGte:
+		return clause.Gte{Column: col, Value: v.Interface()}, true
+	case FilterLt:
+		return clause.Lt{Column: col, Value: v.Interface()}, true
+	case FilterLte:
+		return clause.Lte{Column: col, Value: v.Interface()}, true
+	case FilterLike:
+		return clause.Like{Column: col, Value: "%" + escapeLike(v.String()) + "%"}, true
+	case FilterPrefix:
+		return clause.Like{Column: col, Value: escapeLike(v.String()) + "%"}, true
+	case FilterIn, FilterNotIn:
+		if v.Len() == 0 {
+			return nil, false
+		}
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = v.Index(i).Interface()
+		}
+		if f.op == FilterNotIn {
+			return clause.Not(clause.IN{Column: col, Values: values}), true
+		}
+		return clause.IN{Column: col, Values: values}, true
+	case FilterNull:
+		if v.Bool() {
+			return clause.Expr{SQL: "? IS NULL", Vars: []interface{}{col}}, true
+		}
+		return clause.Expr{SQL: "? IS NOT NULL", Vars: []interface{}{col}}, true
+	default:
+		return clause.Eq{Column: col, Value: v.Interface()}, true
+	}
+}
+
+// filterColumn 不带表名的列使用当前表, 避免联表查询时列名不明确
+func filterColumn(name string) clause.Column {
+	if strings.Contains(name, ".") {
+		return clause.Column{Name: name}
+	}
+	return clause.Column{Table: clause.CurrentTable, Name: name}
+}
+
+// escapeLike 转义LIKE中的通配符
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -1,13 +1,16 @@
 package db
 
 import (
-	"github.com/gin-gonic/gin"
+	"context"
+	"database/sql"
+	"fmt"
 	"github.com/laydong/toolpkg/logx"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"gorm.io/plugin/dbresolver"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,68 +22,340 @@ const (
 	LevelInfo              = "info"
 	LevelWarn              = "warn"
 	LevelError             = "error"
-	dbWriteTime            = 3 * time.Second //使用主库时间
+	dbWriteTime            = 3 * time.Second //写入后使用主库时间
+	gormContextKey         = "grom_cxt"
 )
 
+// DbPoolCfg 连接池配置, 为0时使用默认值
 type DbPoolCfg struct {
 	MaxIdleConn int `json:"max_idle_conn"` //空闲连接数
 	MaxOpenConn int `json:"max_open_conn"` //最大连接数
-	MaxLifeTime int `json:"max_life_time"` //连接可重用的最大时间
-	MaxIdleTime int `json:"max_idle_time"` //在关闭连接之前,连接可能处于空闲状态的最大时间
+	MaxLifeTime int `json:"max_life_time"` //连接可重用的最大时间, 单位秒
+	MaxIdleTime int `json:"max_idle_time"` //在关闭连接之前,连接可能处于空闲状态的最大时间, 单位秒
+}
+
+// DbConf 一个mysql实例的配置, 多个schema时每个schema注册一个实例
+type DbConf struct {
+	Name          string        `json:"name"`           // 实例名称, 为空时为 default
+	Dsn           string        `json:"dsn"`            // 主库
+	Replicas      []string      `json:"replicas"`       // 从库, 使用实例的连接池配置
+	ReplicaConfs  []ReplicaConf `json:"replica_confs"`  // 需要单独设置权重或连接池的从库
+	Pool          DbPoolCfg     `json:"pool"`           // 主库和从库的连接池配置
+	Policy        string        `json:"policy"`         // 从库选择策略 random/weighted/round_robin/least_latency, 默认random
+	ProbeInterval int           `json:"probe_interval"` // 从库健康检查间隔, 单位秒, 默认5秒, 小于0不检查
+
+	StickyWindow   time.Duration `json:"sticky_window"`   // 写入后读主库的时间, 如 3s, 默认3秒, 小于0不切换
+	LagMode        string        `json:"lag_mode"`        // 从库延迟检查方式 replica_status/heartbeat, 为空不检查, 需要开启健康检查
+	HeartbeatTable string        `json:"heartbeat_table"` // heartbeat方式使用的表, 默认 heartbeat, 见 LagHeartbeat
+
+	Audit       bool     `json:"audit"`        // 开启审计日志, 记录 Create、Update、Delete 的操作人和新旧值
+	AuditTables []string `json:"audit_tables"` // 需要审计的表, 为空时审计所有表
+}
+
+// ReplicaConf 从库配置
+type ReplicaConf struct {
+	Dsn    string    `json:"dsn"`
+	Weight int       `json:"weight"` // weighted策略的权重, 默认1
+	Pool   DbPoolCfg `json:"pool"`   // 为0的项使用实例的连接池配置
+}
+
+// DbOptionFunc InitDBWith 的选项
+type DbOptionFunc func(*DbConf)
+
+// WithDBName 设置实例名称
+func WithDBName(name string) DbOptionFunc {
+	return func(c *DbConf) {
+		c.Name = name
+	}
+}
+
+// WithDBPool 设置主库和从库的连接池
+func WithDBPool(cfg DbPoolCfg) DbOptionFunc {
+	return func(c *DbConf) {
+		c.Pool = cfg
+	}
+}
+
+// WithReplica 添加从库, weight为weighted策略的权重, pool不传时使用实例的连接池配置
+func WithReplica(dsn string, weight int, pool ...DbPoolCfg) DbOptionFunc {
+	return func(c *DbConf) {
+		rc := ReplicaConf{Dsn: dsn, Weight: weight}
+		if len(pool) > 0 {
+			rc.Pool = pool[0]
+		}
+		c.ReplicaConfs = append(c.ReplicaConfs, rc)
+	}
+}
+
+// WithPolicy 设置从库选择策略, 见 PolicyRandom 等
+func WithPolicy(policy string) DbOptionFunc {
+	return func(c *DbConf) {
+		c.Policy = policy
+	}
+}
+
+// WithStickyWindow 设置写入后读主库的时间, 小于0时不切换
+func WithStickyWindow(window time.Duration) DbOptionFunc {
+	return func(c *DbConf) {
+		c.StickyWindow = window
+	}
+}
+
+// WithLagMode 设置从库延迟检查方式, 写入后延迟足够小的从库也可以读, 见 LagReplicaStatus 和 LagHeartbeat
+// table 只在 heartbeat 方式使用, 为空时使用 heartbeat 表
+func WithLagMode(mode string, table ...string) DbOptionFunc {
+	return func(c *DbConf) {
+		c.LagMode = mode
+		if len(table) > 0 {
+			c.HeartbeatTable = table[0]
+		}
+	}
+}
+
+// WithProbeInterval 设置从库健康检查间隔, 小于0时不检查
+func WithProbeInterval(interval time.Duration) DbOptionFunc {
+	return func(c *DbConf) {
+		if interval < 0 {
+			c.ProbeInterval = -1
+			return
+		}
+		c.ProbeInterval = int(interval / time.Second)
+	}
+}
+
+// WithAudit 开启审计日志, tables为空时审计所有表
+func WithAudit(tables ...string) DbOptionFunc {
+	return func(c *DbConf) {
+		c.Audit = true
+		c.AuditTables = tables
+	}
 }
 
 var DB *gorm.DB
 
-// InitDB init db
-//dsn string  示例 "账号:密码@tcp(服务器IP:端口)/数据库名?charset=utf8&parseTime=True&loc=Local"
+// InitDB init db, 注册为默认实例并赋值给 DB
+// dsn string  示例 "账号:密码@tcp(服务器IP:端口)/数据库名?charset=utf8&parseTime=True&loc=Local"
 // dsn1  支持多个，后面为从库
+// 与之前一样可以重复调用, 新的实例替换默认实例, 旧实例的连接池不关闭
 func InitDB(dsn string, dsn1 ...string) (db *gorm.DB, err error) {
-	db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{Logger: logx.Default(logger.Info)})
+	return registerDB(DbConf{
+		Name:     DefaultDBName,
+		Dsn:      dsn,
+		Replicas: dsn1,
+	}, true)
+}
+
+// InitDBWith 按选项初始化实例并注册, 默认注册为默认实例, 与 InitDB 一样替换同名实例
+func InitDBWith(dsn string, opts ...DbOptionFunc) (*gorm.DB, error) {
+	conf := DbConf{Name: DefaultDBName, Dsn: dsn}
+	for _, f := range opts {
+		f(&conf)
+	}
+	return registerDB(conf, true)
+}
+
+// openDB 打开主库和从库的连接池, 从库为空时读写都使用主库
+// 每个从库使用独立的连接池, 健康检查失败的从库不再参与选择, 所有从库都不可用时读主库
+func openDB(conf DbConf) (ins *dbInstance, err error) {
+	ins = &dbInstance{conf: conf}
+	defer func() {
+		if err != nil {
+			_ = ins.close()
+		}
+	}()
+
+	ins.source, err = openSqlDB(conf.Dsn, conf.Pool)
 	if err != nil {
 		return
 	}
+	replicaConfs := make([]ReplicaConf, 0, len(conf.Replicas)+len(conf.ReplicaConfs))
+	for _, v := range conf.Replicas {
+		replicaConfs = append(replicaConfs, ReplicaConf{Dsn: v})
+	}
+	replicaConfs = append(replicaConfs, conf.ReplicaConfs...)
+
+	lag, err := newLagChecker(conf.LagMode, conf.HeartbeatTable)
+	if err != nil {
+		return
+	}
+	if lag != nil && conf.ProbeInterval < 0 {
+		err = fmt.Errorf("lag mode %s needs probe", conf.LagMode)
+		return
+	}
+
 	var replicas []gorm.Dialector
-	if len(dsn1) > 0 {
-		for _, v := range dsn1 {
-			replicas = append(replicas, mysql.Open(v))
+	for _, rc := range replicaConfs {
+		r := &replica{dsn: rc.Dsn, weight: rc.Weight, healthy: 1, lag: -1}
+		if r.weight <= 0 {
+			r.weight = 1
 		}
+		r.pool, err = openSqlDB(rc.Dsn, mergePool(rc.Pool, conf.Pool))
+		if err != nil {
+			return
+		}
+		ins.replicas = append(ins.replicas, r)
+		// 不查询版本, 启动时从库不可用也不影响初始化
+		replicas = append(replicas, mysql.New(mysql.Config{DSN: rc.Dsn, Conn: r.pool, SkipInitializeWithVersion: true}))
 	}
-	if len(replicas) == 0 {
-		//单库
-		replicas = append(replicas, mysql.Open(dsn))
+
+	db, err := gorm.Open(mysql.New(mysql.Config{DSN: conf.Dsn, Conn: ins.source}), &gorm.Config{Logger: logx.Default(logger.Info)})
+	if err != nil {
+		return
 	}
 	//主从库
-	db.Use(dbresolver.Register(dbresolver.Config{
-		Sources:  []gorm.Dialector{mysql.Open(dsn)},
-		Replicas: replicas,
-		Policy:   dbresolver.RandomPolicy{},
-	}).SetConnMaxIdleTime(defaultPoolMaxIdle).
-		SetConnMaxLifetime(defaultConnMaxLifeTime).
-		SetMaxIdleConns(defaultPoolMaxIdle).
-		SetMaxOpenConns(defaultPoolMaxOpen))
-
-	err = Initialize(db)
+	if len(replicas) > 0 {
+		var policy *replicaPolicy
+		policy, err = newReplicaPolicy(conf.Policy, ins.source, ins.replicas)
+		if err != nil {
+			return
+		}
+		// 主库放在最后只作为兜底, 见 replicaPolicy
+		replicas = append(replicas, mysql.New(mysql.Config{DSN: conf.Dsn, Conn: ins.source, SkipInitializeWithVersion: true}))
+		err = db.Use(dbresolver.Register(dbresolver.Config{
+			Replicas: replicas,
+			Policy:   policy,
+		}))
+		if err != nil {
+			return
+		}
+		if conf.ProbeInterval >= 0 {
+			interval := defaultProbeInterval
+			if conf.ProbeInterval > 0 {
+				interval = time.Duration(conf.ProbeInterval) * time.Second
+			}
+			ins.prober = newReplicaProber(conf.Name, interval, ins.replicas, lag)
+		}
+	}
+
+	err = initialize(db, ins)
 	if err != nil {
 		return
 	}
+	ins.db = db
 	//执行sql 主从
-	registerReplicaCallbacks(db)
-	if err != nil {
-		return
+	registerReplicaCallbacks(ins)
+	if conf.Audit {
+		registerAuditCallbacks(ins)
+	}
+	return
+}
+
+// mergePool 从库为0的配置项使用实例的配置
+func mergePool(cfg, def DbPoolCfg) DbPoolCfg {
+	if cfg.MaxIdleConn <= 0 {
+		cfg.MaxIdleConn = def.MaxIdleConn
+	}
+	if cfg.MaxOpenConn <= 0 {
+		cfg.MaxOpenConn = def.MaxOpenConn
 	}
-	err = DbSurvive(db)
+	if cfg.MaxLifeTime <= 0 {
+		cfg.MaxLifeTime = def.MaxLifeTime
+	}
+	if cfg.MaxIdleTime <= 0 {
+		cfg.MaxIdleTime = def.MaxIdleTime
+	}
+	return cfg
+}
+
+// openSqlDB 打开一个连接池并按配置设置, 配置为0的使用默认值
+func openSqlDB(dsn string, cfg DbPoolCfg) (*sql.DB, error) {
+	sqlDB, err := sql.Open("mysql", dsn)
 	if err != nil {
+		return nil, err
 	}
-	DB = db
-	return
+
+	maxIdle, maxOpen := defaultPoolMaxIdle, defaultPoolMaxOpen
+	lifeTime, idleTime := defaultConnMaxLifeTime, defaultConnMaxIdleTime
+	if cfg.MaxIdleConn > 0 {
+		maxIdle = cfg.MaxIdleConn
+	}
+	if cfg.MaxOpenConn > 0 {
+		maxOpen = cfg.MaxOpenConn
+	}
+	if cfg.MaxLifeTime > 0 {
+		lifeTime = time.Duration(cfg.MaxLifeTime) * time.Second
+	}
+	if cfg.MaxIdleTime > 0 {
+		idleTime = time.Duration(cfg.MaxIdleTime) * time.Second
+	}
+	sqlDB.SetMaxIdleConns(maxIdle)
+	sqlDB.SetMaxOpenConns(maxOpen)
+	sqlDB.SetConnMaxLifetime(lifeTime)
+	sqlDB.SetConnMaxIdleTime(idleTime)
+	return sqlDB, nil
+}
+
+// GetDB 获取绑定了context的DB, c可以是 gin.Context、appx.Context、grpcx.GrpcContext 等任意 context.Context
+// context取消或超时后正在执行的sql也会被取消
+// dbName 为注册时的实例名称, 为空时使用默认实例, 实例不存在时返回带有错误的DB, 执行时返回该错误
+// 注意: 之前 dbName 是保存context的key, 现在是实例名称, 传自定义key的调用方需要去掉该参数, 保存context的key固定为 grom_cxt
+// c中有正在执行的事务时返回事务, 见 Transaction
+func GetDB(c context.Context, dbName ...string) *gorm.DB {
+	name := DefaultDBName
+	if len(dbName) > 0 && dbName[0] != "" {
+		name = dbName[0]
+	}
+	if st := getTx(c, name); st != nil {
+		return st.tx.Set(gormContextKey, c).WithContext(c)
+	}
+
+	db := DB
+	if name != DefaultDBName || db == nil {
+		var err error
+		if db, err = LookupDB(name); err != nil {
+			return errDB(c, err)
+		}
+	}
+	return db.Set(gormContextKey, c).WithContext(c)
+}
+
+var (
+	errDBOnce sync.Once
+	errDBBase *gorm.DB
+)
+
+// errDB 返回带有错误的DB, 不依赖 DB 和任何注册的实例, 执行时返回err, 不会连接数据库
+func errDB(c context.Context, err error) *gorm.DB {
+	errDBOnce.Do(func() {
+		errDBBase, _ = gorm.Open(mysql.New(mysql.Config{Conn: errConnPool{}, SkipInitializeWithVersion: true}),
+			&gorm.Config{Logger: logger.Discard})
+	})
+	tx := errDBBase.Session(&gorm.Session{NewDB: true, Context: c})
+	tx.Statement.ConnPool = errConnPool{err: err}
+	_ = tx.AddError(err)
+	return tx
+}
+
+// errConnPool errDB 使用的连接池, 所有操作返回err
+type errConnPool struct {
+	err error
 }
 
-func GetDB(c *gin.Context, dbNmae ...string) *gorm.DB {
-	key := "grom_cxt"
-	if len(dbNmae) > 0 {
-		key = dbNmae[0]
+func (p errConnPool) error() error {
+	if p.err == nil {
+		return sql.ErrConnDone
 	}
-	return DB.Set(key, c).WithContext(c)
+	return p.err
+}
+
+func (p errConnPool) PrepareContext(context.Context, string) (*sql.Stmt, error) {
+	return nil, p.error()
+}
+
+func (p errConnPool) ExecContext(context.Context, string, ...interface{}) (sql.Result, error) {
+	return nil, p.error()
+}
+
+func (p errConnPool) QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error) {
+	return nil, p.error()
+}
+
+func (p errConnPool) QueryRowContext(context.Context, string, ...interface{}) *sql.Row {
+	return nil
+}
+
+func (p errConnPool) BeginTx(context.Context, *sql.TxOptions) (gorm.ConnPool, error) {
+	return nil, p.error()
 }
 
 // DbSurvive mysql survive
@@ -102,70 +377,88 @@ const (
 	callBackAfterName  = "opentracing:after"
 )
 
+// Initialize 注册链路追踪的回调, 每条sql在 context 中的链路下开启一个子span
 func Initialize(db *gorm.DB) (err error) {
+	return initialize(db, nil)
+}
+
+// initialize ins不为空时可以区分主库和从库
+func initialize(db *gorm.DB, ins *dbInstance) (err error) {
+	t := &gormTracer{ins: ins}
 	// 开始前 - 并不是都用相同的方法，可以自己自定义
-	db.Callback().Create().Before("gorm:before_create").Register(callBackBeforeName, func(db *gorm.DB) {})
-	db.Callback().Query().Before("gorm:query").Register(callBackBeforeName, func(db *gorm.DB) {})
-	db.Callback().Delete().Before("gorm:before_delete").Register(callBackBeforeName, func(db *gorm.DB) {})
-	db.Callback().Update().Before("gorm:setup_reflect_value").Register(callBackBeforeName, func(db *gorm.DB) {})
-	db.Callback().Row().Before("gorm:row").Register(callBackBeforeName, func(db *gorm.DB) {})
-	db.Callback().Raw().Before("gorm:raw").Register(callBackBeforeName, func(db *gorm.DB) {})
+	db.Callback().Create().Before("gorm:before_create").Register(callBackBeforeName, t.before("create"))
+	db.Callback().Query().Before("gorm:query").Register(callBackBeforeName, t.before("query"))
+	db.Callback().Delete().Before("gorm:before_delete").Register(callBackBeforeName, t.before("delete"))
+	db.Callback().Update().Before("gorm:setup_reflect_value").Register(callBackBeforeName, t.before("update"))
+	db.Callback().Row().Before("gorm:row").Register(callBackBeforeName, t.before("row"))
+	db.Callback().Raw().Before("gorm:raw").Register(callBackBeforeName, t.before("raw"))
 
 	// 结束后 - 并不是都用相同的方法，可以自己自定义
-	db.Callback().Create().After("gorm:after_create").Register(callBackAfterName, func(db *gorm.DB) {})
-	db.Callback().Query().After("gorm:after_query").Register(callBackAfterName, func(db *gorm.DB) {})
-	db.Callback().Delete().After("gorm:after_delete").Register(callBackAfterName, func(db *gorm.DB) {})
-	db.Callback().Update().After("gorm:after_update").Register(callBackAfterName, func(db *gorm.DB) {})
-	db.Callback().Row().After("gorm:row").Register(callBackAfterName, func(db *gorm.DB) {})
-	db.Callback().Raw().After("gorm:raw").Register(callBackAfterName, func(db *gorm.DB) {})
+	db.Callback().Create().After("gorm:after_create").Register(callBackAfterName, t.after)
+	db.Callback().Query().After("gorm:after_query").Register(callBackAfterName, t.after)
+	db.Callback().Delete().After("gorm:after_delete").Register(callBackAfterName, t.after)
+	db.Callback().Update().After("gorm:after_update").Register(callBackAfterName, t.after)
+	db.Callback().Row().After("gorm:row").Register(callBackAfterName, t.after)
+	db.Callback().Raw().After("gorm:raw").Register(callBackAfterName, t.after)
 	return
 }
 
 // 记录主库写入时间，在查询的时候动态选择主库或从库
-func registerReplicaCallbacks(db *gorm.DB) {
-	db.Callback().Create().After("gorm:create").Register("record_write_time", recordWriteTime)
-	db.Callback().Update().After("gorm:update").Register("record_write_time", recordWriteTime)
-	db.Callback().Delete().After("gorm:delete").Register("record_write_time", recordWriteTime)
-	db.Callback().Raw().After("gorm:raw").Register("record_write_time", recordRawWriteTime)
-	db.Callback().Query().Before("gorm:query").Register("dynamic_read_write_clauses", dynamicReadWriteClauses)
-	db.Callback().Row().Before("gorm:row").Register("dynamic_read_write_clauses", dynamicReadWriteClauses)
+func registerReplicaCallbacks(ins *dbInstance) {
+	db := ins.db
+	db.Callback().Create().After("gorm:create").Register("record_write_time", ins.recordWriteTime)
+	db.Callback().Update().After("gorm:update").Register("record_write_time", ins.recordWriteTime)
+	db.Callback().Delete().After("gorm:delete").Register("record_write_time", ins.recordWriteTime)
+	db.Callback().Raw().After("gorm:raw").Register("record_write_time", ins.recordRawWriteTime)
+	db.Callback().Query().Before("gorm:query").Register("dynamic_read_write_clauses", ins.dynamicReadWriteClauses)
+	db.Callback().Row().Before("gorm:row").Register("dynamic_read_write_clauses", ins.dynamicReadWriteClauses)
+	db.Callback().Raw().Before("gorm:raw").Register("dynamic_read_write_clauses", ins.dynamicReadWriteClauses)
 }
 
 // 记录执行写入的时间
-func recordWriteTime(db *gorm.DB) {
-	ctx, ok := db.Statement.Context.(*gin.Context)
-	if ok {
-		ctx.Set("DBWriteTime", time.Now())
+func (ins *dbInstance) recordWriteTime(db *gorm.DB) {
+	if db.Error == nil {
+		markWrite(db.Statement.Context, ins.conf.Name)
 	}
 }
 
 // 记录执行写入的时间
-func recordRawWriteTime(db *gorm.DB) {
-	ctx, ok := db.Statement.Context.(*gin.Context)
-	if ok {
-		sql := db.Statement.SQL.String()
-		if len(sql) >= 6 {
-			prefix := strings.ToLower(sql[0:6])
-			if prefix == "insert" || prefix == "update" || prefix == "delete" {
-				ctx.Set("DBWriteTime", time.Now())
-			}
+func (ins *dbInstance) recordRawWriteTime(db *gorm.DB) {
+	if db.Error != nil {
+		return
+	}
+	sql := strings.TrimSpace(db.Statement.SQL.String())
+	if len(sql) >= 6 {
+		prefix := strings.ToLower(sql[0:6])
+		if prefix == "insert" || prefix == "update" || prefix == "delete" || prefix == "replac" {
+			markWrite(db.Statement.Context, ins.conf.Name)
 		}
 	}
 }
 
 // 动态选择使用主库还是从库
-// 如果当前请求在 x 秒内刚执行过写入操作，则强制使用主库进行查询操作
-func dynamicReadWriteClauses(db *gorm.DB) {
-	ctx, ok := db.Statement.Context.(*gin.Context)
-	if !ok {
+// 如果当前请求在 StickyWindow 内刚执行过写入操作，则强制使用主库进行查询操作
+// 开启从库延迟检查时, 延迟小于距离写入时间的从库也可以读
+func (ins *dbInstance) dynamicReadWriteClauses(db *gorm.DB) {
+	r, ok := ins.replicaOf(db.Statement.ConnPool)
+	if !ok || ins.conf.StickyWindow < 0 {
 		return
 	}
-	value, ok2 := ctx.Get("DBWriteTime")
-	if !ok2 {
+	since, ok := sinceWrite(db.Statement.Context, ins.conf.Name)
+	if !ok || since > ins.stickyWindow() {
 		return
 	}
-	writeTime, ok3 := value.(time.Time)
-	if ok3 && time.Now().Sub(writeTime) <= dbWriteTime {
-		db = db.Clauses(dbresolver.Write)
+
+	if ins.conf.LagMode != "" {
+		if r.safeSince(since) {
+			return
+		}
+		for _, other := range ins.replicas {
+			if other.isHealthy() && other.safeSince(since) {
+				db.Statement.ConnPool = other.pool
+				return
+			}
+		}
 	}
+	db.Statement.ConnPool = ins.source
 }
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"errors"
+	"github.com/laydong/toolpkg/tracex"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"gorm.io/gorm"
+	"time"
+)
+
+const (
+	gormSpanKey  = "opentracing:span"
+	gormStartKey = "query:start"
+	rolePrimary  = "primary"
+	roleReplica  = "replica"
+)
+
+// gormTracer 在sql执行前开启子span, 执行后记录sql、表、影响行数、错误和主从并结束span
+// 同时统计请求内的查询次数和耗时, 见 QueryBudget
+type gormTracer struct {
+	ins *dbInstance
+}
+
+func (t *gormTracer) before(op string) func(db *gorm.DB) {
+	name := "mysql:" + op
+	return func(db *gorm.DB) {
+		db.InstanceSet(gormStartKey, time.Now())
+		tc := tracex.FromContext(db.Statement.Context)
+		if tc == nil {
+			return
+		}
+		span := tc.ChildSpan(name, ext.SpanKindRPCClient)
+		if span == nil {
+			return
+		}
+		ext.DBType.Set(span, "sql")
+		ext.Component.Set(span, "gorm")
+		db.InstanceSet(gormSpanKey, span)
+	}
+}
+
+func (t *gormTracer) after(db *gorm.DB) {
+	if val, ok := db.InstanceGet(gormStartKey); ok {
+		if begin, ok := val.(time.Time); ok {
+			recordQuery(db, time.Since(begin))
+		}
+	}
+
+	val, ok := db.InstanceGet(gormSpanKey)
+	if !ok {
+		return
+	}
+	span, ok := val.(opentracing.Span)
+	if !ok || span == nil {
+		return
+	}
+	defer span.Finish()
+
+	ext.DBStatement.Set(span, db.Statement.SQL.String())
+	span.SetTag("db.table", db.Statement.Table)
+	span.SetTag("db.rows_affected", db.RowsAffected)
+	span.SetTag("db.role", t.role(db))
+	if db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound) {
+		ext.Error.Set(span, true)
+		span.LogKV("error", db.Error.Error())
+	}
+}
+
+// role 事务和没有从库时都是主库
+func (t *gormTracer) role(db *gorm.DB) string {
+	if t.ins == nil {
+		return rolePrimary
+	}
+	if _, ok := t.ins.replicaOf(db.Statement.ConnPool); ok {
+		return roleReplica
+	}
+	return rolePrimary
+}
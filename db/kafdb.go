@@ -1,7 +1,10 @@
 package db
 
 import (
+	"context"
 	"github.com/Shopify/sarama"
+	"github.com/laydong/toolpkg/datax"
+	"github.com/laydong/toolpkg/utils"
 )
 
 /*
@@ -30,6 +33,50 @@ func InitKafkaProducer(dsn, username, password string) (db *sarama.SyncProducer,
 	return &client, er
 }
 
+// NewKafkaMessage 创建kafka消息, ctx中的request_id和baggage(租户id、流量标记等)写入消息header
+func NewKafkaMessage(ctx context.Context, topic string, key, value []byte) *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(value),
+	}
+	if key != nil {
+		msg.Key = sarama.ByteEncoder(key)
+	}
+	if ctx == nil {
+		return msg
+	}
+
+	if logId, ok := ctx.Value(utils.RequestIdKey).(string); ok && logId != "" {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(utils.RequestIdKey), Value: []byte(logId)})
+	}
+	datax.InjectBaggage(ctx, func(header, value string) {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(header), Value: []byte(value)})
+	})
+	return msg
+}
+
+// SendKafkaMessage 发送kafka消息, 自动携带ctx中的request_id和baggage
+func SendKafkaMessage(ctx context.Context, producer sarama.SyncProducer, topic string, key, value []byte) (partition int32, offset int64, err error) {
+	return producer.SendMessage(NewKafkaMessage(ctx, topic, key, value))
+}
+
+// KafkaHeader 获取消费到的消息的header, 不存在时返回空字符串
+func KafkaHeader(msg *sarama.ConsumerMessage, key string) string {
+	for _, h := range msg.Headers {
+		if h != nil && string(h.Key) == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// ExtractKafkaBaggage 消费端将消息header中的baggage写回dc, 与httpx、grpcx收到请求时的处理相同
+func ExtractKafkaBaggage(dc datax.DataContext, msg *sarama.ConsumerMessage) {
+	datax.ExtractBaggage(dc, func(header string) string {
+		return KafkaHeader(msg, header)
+	})
+}
+
 /*
 *InitKafkaConsumer 获取消费端
 dsn string localhost:9093
@@ -0,0 +1,189 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/laydong/toolpkg/logx"
+	"github.com/laydong/toolpkg/tracex"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/event"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMongoSlowThreshold = 100 * time.Millisecond
+	mongoStatementMaxLen      = 2048 // 日志和链路中命令的最大长度
+)
+
+type mgoCommandState struct {
+	begin      time.Time
+	requestId  string
+	span       opentracing.Span
+	request    mongoRequestLog
+	connection string
+}
+
+// mgoMonitor 每条命令开启子span, 执行后写 mongo_log, 超过慢命令阈值时使用warn级别
+// 开始和结束事件通过驱动的RequestID关联
+type mgoMonitor struct {
+	slowThreshold time.Duration
+	commands      sync.Map // int64 => *mgoCommandState
+}
+
+func newMgoMonitor(conf MgoConf) *event.CommandMonitor {
+	m := &mgoMonitor{slowThreshold: conf.SlowThreshold}
+	if m.slowThreshold == 0 {
+		m.slowThreshold = defaultMongoSlowThreshold
+	}
+	return &event.CommandMonitor{
+		Started: m.started,
+		Succeeded: func(ctx context.Context, evt *event.CommandSucceededEvent) {
+			m.finished(evt.CommandFinishedEvent, "")
+		},
+		Failed: func(ctx context.Context, evt *event.CommandFailedEvent) {
+			m.finished(evt.CommandFinishedEvent, evt.Failure)
+		},
+	}
+}
+
+func (m *mgoMonitor) started(ctx context.Context, evt *event.CommandStartedEvent) {
+	st := &mgoCommandState{
+		begin:      time.Now(),
+		requestId:  logx.RequestIdFromContext(ctx),
+		connection: evt.ConnectionID,
+		request: mongoRequestLog{
+			Database:  evt.DatabaseName,
+			Cmd:       evt.CommandName,
+			Statement: truncate(maskCommand(evt.Command), mongoStatementMaxLen),
+			Line:      callerLine("go.mongodb.org/"),
+		},
+	}
+	if elem, err := evt.Command.IndexErr(0); err == nil {
+		st.request.Collection, _ = elem.Value().StringValueOK()
+	}
+	if tc := tracex.FromContext(ctx); tc != nil {
+		if span := tc.ChildSpan("mongo:"+evt.CommandName, ext.SpanKindRPCClient); span != nil {
+			ext.DBType.Set(span, "mongo")
+			ext.DBInstance.Set(span, evt.DatabaseName)
+			ext.DBStatement.Set(span, st.request.Statement)
+			ext.Component.Set(span, "mongo-driver")
+			ext.PeerAddress.Set(span, evt.ConnectionID)
+			st.span = span
+		}
+	}
+	m.commands.Store(evt.RequestID, st)
+}
+
+func (m *mgoMonitor) finished(evt event.CommandFinishedEvent, failure string) {
+	v, ok := m.commands.LoadAndDelete(evt.RequestID)
+	if !ok {
+		return
+	}
+	st := v.(*mgoCommandState)
+	elapsed := time.Duration(evt.DurationNanos)
+	end := st.begin.Add(elapsed)
+
+	if st.span != nil {
+		if failure != "" {
+			ext.Error.Set(st.span, true)
+			st.span.LogKV("error", failure)
+		}
+		st.span.FinishWithOptions(opentracing.FinishOptions{FinishTime: end})
+	}
+
+	requestId := st.requestId
+	if requestId == "" {
+		requestId = "null"
+	}
+	request := st.request
+	request.Addr = st.connection
+	fields := []interface{}{
+		zap.Any("datetime", st.begin.Format(logx.TimeFormat)),
+		zap.String(logx.MessageType, "mongo_log"),
+		zap.String(logx.RequestIdKey, requestId),
+		zap.Any("request", request),
+		zap.String("respon", failure),
+		zap.Any("start_time", float64(st.begin.UnixNano())/1e9),
+		zap.Any("end_time", float64(end.UnixNano())/1e9),
+		zap.String("run_time", formatMs(elapsed)),
+	}
+	switch {
+	case failure != "":
+		logx.Error("mongo_log", fields...)
+	case m.slowThreshold > 0 && elapsed >= m.slowThreshold:
+		request.SlowLog = fmt.Sprintf("SLOW MONGO >= %v", m.slowThreshold)
+		fields[3] = zap.Any("request", request)
+		logx.Warn("mongo_log", fields...)
+	default:
+		logx.Info("mongo_log", fields...)
+	}
+}
+
+type mongoRequestLog struct {
+	Addr       string `json:"addr"`
+	Database   string `json:"database"`
+	Cmd        string `json:"cmd"`
+	Collection string `json:"collection"`
+	Statement  string `json:"statement"`
+	SlowLog    string `json:"slow_log"`
+	Line       string `json:"line"`
+}
+
+// maskCommand 按 logx.SetSqlMask 的规则隐藏命令中的敏感值, 字段名与列名规则匹配时替换整个值, 字符串按正则替换
+// $in 等操作符使用所属字段的名称
+func maskCommand(cmd bson.Raw) string {
+	var doc bson.D
+	if err := bson.Unmarshal(cmd, &doc); err != nil {
+		return ""
+	}
+	data, err := bson.MarshalExtJSON(maskBsonDoc("", doc), false, false)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func maskBsonDoc(parent string, doc bson.D) bson.D {
+	out := make(bson.D, len(doc))
+	for i, e := range doc {
+		key := e.Key
+		if strings.HasPrefix(key, "$") && parent != "" {
+			key = parent
+		}
+		out[i] = bson.E{Key: e.Key, Value: maskBsonValue(key, e.Value)}
+	}
+	return out
+}
+
+func maskBsonValue(key string, v interface{}) interface{} {
+	switch val := v.(type) {
+	case bson.D:
+		if replace, _ := logx.MaskValue(key, "").(string); replace != "" {
+			return replace
+		}
+		return maskBsonDoc(key, val)
+	case bson.A:
+		if replace, _ := logx.MaskValue(key, "").(string); replace != "" {
+			return replace
+		}
+		out := make(bson.A, len(val))
+		for i, item := range val {
+			out[i] = maskBsonValue(key, item)
+		}
+		return out
+	default:
+		return logx.MaskValue(key, v)
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,541 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/laydong/toolpkg/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/plugin/dbresolver"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMigrationTable   = "schema_migrations"
+	defaultMigrationLock    = "db:migrate:lock"
+	defaultMigrationLockTTL = 10 * time.Minute // 迁移锁的过期时间, 应大于所有迁移的执行时间
+	defaultMigrationWait    = time.Minute      // 等待其他副本迁移完成的最长时间
+)
+
+// ErrMigrationChanged 已经执行过的迁移被修改
+var ErrMigrationChanged = errors.New("db: applied migration changed")
+
+// Migration 一个版本的迁移, SQL和Go函数二选一, 同时设置时先执行SQL
+// 版本号都是数字时按数值排序, 否则按字符串排序, 建议使用时间戳, 如 20220901120000
+type Migration struct {
+	Version  string
+	Name     string
+	UpSQL    string
+	DownSQL  string
+	Up       func(tx *gorm.DB) error
+	Down     func(tx *gorm.DB) error
+	Checksum string // Go迁移无法计算校验和, 需要检查时手动设置, SQL迁移为空时自动计算
+}
+
+func (m *Migration) checksum() string {
+	if m.Checksum != "" || (m.UpSQL == "" && m.DownSQL == "") {
+		return m.Checksum
+	}
+	sum := sha256.Sum256([]byte(m.UpSQL + "\n--down--\n" + m.DownSQL))
+	return hex.EncodeToString(sum[:])
+}
+
+// MigrationRecord 迁移表中的记录
+type MigrationRecord struct {
+	Version   string    `gorm:"primaryKey;size:191"`
+	Name      string    `gorm:"size:255"`
+	Checksum  string    `gorm:"size:64"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// MigrationStatus 迁移状态
+type MigrationStatus struct {
+	Version   string
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// MigrateOptions 迁移选项
+type MigrateOptions struct {
+	Table    string                // 迁移表, 默认 schema_migrations
+	Rdb      redis.UniversalClient // 设置后迁移时加锁, 多副本同时启动时只有一个执行迁移
+	LockKey  string                // 锁的key, 默认 db:migrate:lock
+	LockTTL  time.Duration         // 锁的过期时间, 迁移期间自动续期, 默认10分钟
+	LockWait time.Duration         // 等待锁的时间, 默认1分钟
+	DryRun   bool                  // 只打印要执行的SQL, 不执行也不写迁移表
+	Output   io.Writer             // DryRun 的输出, 默认 os.Stdout
+}
+
+type MigrateOptionFunc func(*MigrateOptions)
+
+// WithMigrationTable 设置迁移表
+func WithMigrationTable(table string) MigrateOptionFunc {
+	return func(o *MigrateOptions) {
+		if table != "" {
+			o.Table = table
+		}
+	}
+}
+
+// WithMigrationLock 使用redis锁防止多个副本同时迁移, key为空时使用默认值
+func WithMigrationLock(rdb redis.UniversalClient, key string) MigrateOptionFunc {
+	return func(o *MigrateOptions) {
+		o.Rdb = rdb
+		if key != "" {
+			o.LockKey = key
+		}
+	}
+}
+
+// WithMigrationLockTTL 设置锁的过期时间和等待时间
+func WithMigrationLockTTL(ttl, wait time.Duration) MigrateOptionFunc {
+	return func(o *MigrateOptions) {
+		if ttl > 0 {
+			o.LockTTL = ttl
+		}
+		if wait > 0 {
+			o.LockWait = wait
+		}
+	}
+}
+
+// WithDryRun 只打印要执行的SQL, w为空时打印到标准输出
+func WithDryRun(w io.Writer) MigrateOptionFunc {
+	return func(o *MigrateOptions) {
+		o.DryRun = true
+		if w != nil {
+			o.Output = w
+		}
+	}
+}
+
+// Migrator 按版本执行迁移, 已执行的版本记录在迁移表中
+// 可以用于 InitDB、RegisterDB 创建的任意实例, 迁移始终在主库执行
+type Migrator struct {
+	db         *gorm.DB
+	opts       MigrateOptions
+	migrations []*Migration
+}
+
+// NewMigrator 创建迁移
+func NewMigrator(db *gorm.DB, opts ...MigrateOptionFunc) *Migrator {
+	o := MigrateOptions{
+		Table:    defaultMigrationTable,
+		LockKey:  defaultMigrationLock,
+		LockTTL:  defaultMigrationLockTTL,
+		LockWait: defaultMigrationWait,
+		Output:   os.Stdout,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+	return &Migrator{db: db, opts: o}
+}
+
+// Add 添加迁移, 版本号重复时后添加的会在执行时报错
+func (m *Migrator) Add(migrations ...Migration) *Migrator {
+	for i := range migrations {
+		mg := migrations[i]
+		m.migrations = append(m.migrations, &mg)
+	}
+	return m
+}
+
+// AddFS 从目录中加载SQL迁移, 文件名格式为 版本号_名称.up.sql 和 版本号_名称.down.sql
+// 可以配合 embed.FS 使用, 本地目录使用 os.DirFS
+func (m *Migrator) AddFS(fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+
+	byVersion := map[string]*Migration{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		file := e.Name()
+		var up bool
+		switch {
+		case strings.HasSuffix(file, ".up.sql"):
+			up = true
+		case strings.HasSuffix(file, ".down.sql"):
+		default:
+			continue
+		}
+		base := strings.TrimSuffix(strings.TrimSuffix(file, ".sql"), map[bool]string{true: ".up", false: ".down"}[up])
+		version, name := base, ""
+		if i := strings.Index(base, "_"); i > 0 {
+			version, name = base[:i], base[i+1:]
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join(dir, file))
+		if err != nil {
+			return err
+		}
+		mg, ok := byVersion[version]
+		if !ok {
+			mg = &Migration{Version: version, Name: name}
+			byVersion[version] = mg
+		}
+		if up {
+			mg.UpSQL = string(content)
+		} else {
+			mg.DownSQL = string(content)
+		}
+	}
+	for _, mg := range byVersion {
+		m.migrations = append(m.migrations, mg)
+	}
+	return nil
+}
+
+// Up 执行所有未执行的迁移
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func(db *gorm.DB) error {
+		applied, err := m.prepare(db)
+		if err != nil {
+			return err
+		}
+		for _, mg := range m.migrations {
+			if _, ok := applied[mg.Version]; ok {
+				continue
+			}
+			if err = m.apply(db, mg, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Down 按版本倒序回滚最近执行的steps个迁移
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(db *gorm.DB) error {
+		applied, err := m.prepare(db)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			mg := m.migrations[i]
+			if _, ok := applied[mg.Version]; !ok {
+				continue
+			}
+			if mg.DownSQL == "" && mg.Down == nil {
+				return fmt.Errorf("db: migration %s has no down", mg.Version)
+			}
+			if err = m.apply(db, mg, false); err != nil {
+				return err
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// Status 获取所有迁移的执行状态
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	db := m.session(ctx)
+	if err := m.sort(); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mg := range m.migrations {
+		st := MigrationStatus{Version: mg.Version, Name: mg.Name}
+		if r, ok := applied[mg.Version]; ok {
+			st.Applied, st.AppliedAt = true, r.AppliedAt
+		}
+		list = append(list, st)
+	}
+	return list, nil
+}
+
+// withLock 加锁后执行, 没有设置redis时直接执行
+func (m *Migrator) withLock(ctx context.Context, fn func(db *gorm.DB) error) error {
+	db := m.session(ctx)
+	if m.opts.Rdb == nil || m.opts.DryRun {
+		return fn(db)
+	}
+
+	lock := utils.NewRedisLock(m.opts.Rdb, m.opts.LockKey, utils.WithLockTTL(m.opts.LockTTL))
+	waitCtx, cancel := context.WithTimeout(ctx, m.opts.LockWait)
+	defer cancel()
+	if err := lock.Lock(waitCtx); err != nil {
+		return fmt.Errorf("db: migration lock %s not acquired: %w", m.opts.LockKey, err)
+	}
+	defer lock.Unlock(context.Background())
+	return fn(db)
+}
+
+// session 迁移始终使用主库, 返回的会话可以重复使用
+func (m *Migrator) session(ctx context.Context) *gorm.DB {
+	return m.db.WithContext(ctx).Clauses(dbresolver.Write).Session(&gorm.Session{})
+}
+
+// prepare 创建迁移表, 检查已执行的迁移没有被修改, DryRun 时不创建迁移表
+func (m *Migrator) prepare(db *gorm.DB) (map[string]MigrationRecord, error) {
+	if err := m.sort(); err != nil {
+		return nil, err
+	}
+	if !m.opts.DryRun {
+		if err := db.Table(m.opts.Table).AutoMigrate(&MigrationRecord{}); err != nil {
+			return nil, err
+		}
+	}
+	applied, err := m.applied(db)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mg := range m.migrations {
+		r, ok := applied[mg.Version]
+		if !ok {
+			continue
+		}
+		if sum := mg.checksum(); sum != "" && r.Checksum != "" && sum != r.Checksum {
+			return nil, fmt.Errorf("%w: %s %s", ErrMigrationChanged, mg.Version, mg.Name)
+		}
+	}
+	return applied, nil
+}
+
+// applied 获取已执行的迁移, 迁移表不存在时为空
+func (m *Migrator) applied(db *gorm.DB) (map[string]MigrationRecord, error) {
+	if !db.Migrator().HasTable(m.opts.Table) {
+		return map[string]MigrationRecord{}, nil
+	}
+	var records []MigrationRecord
+	if err := db.Table(m.opts.Table).Find(&records).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[string]MigrationRecord, len(records))
+	for _, r := range records {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// sort 按版本排序并检查版本号
+func (m *Migrator) sort() error {
+	sort.SliceStable(m.migrations, func(i, j int) bool {
+		return versionLess(m.migrations[i].Version, m.migrations[j].Version)
+	})
+	for i, mg := range m.migrations {
+		if mg.Version == "" {
+			return errors.New("db: migration version is empty")
+		}
+		if i > 0 && m.migrations[i-1].Version == mg.Version {
+			return fmt.Errorf("db: duplicate migration version %s", mg.Version)
+		}
+	}
+	return nil
+}
+
+// versionLess 两个版本号都是数字时按数值比较, 2 在 10 之前, 否则按字符串比较
+func versionLess(a, b string) bool {
+	if isDigits(a) && isDigits(b) {
+		x, y := strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		if len(x) != len(y) {
+			return len(x) < len(y)
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return a < b
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// apply 在事务中执行一个迁移并更新迁移表
+// 注意MySQL的DDL会隐式提交, 包含DDL的迁移失败时可能只执行了一部分
+func (m *Migrator) apply(db *gorm.DB, mg *Migration, up bool) error {
+	query, fn, action := mg.UpSQL, mg.Up, "up"
+	if !up {
+		query, fn, action = mg.DownSQL, mg.Down, "down"
+	}
+
+	if m.opts.DryRun {
+		return m.dryRun(db, mg, query, fn, action)
+	}
+
+	begin := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range splitSQL(query) {
+			if err := tx.Exec(stmt).Error; err != nil {
+				return err
+			}
+		}
+		if fn != nil {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+		if up {
+			return tx.Table(m.opts.Table).Create(&MigrationRecord{
+				Version:   mg.Version,
+				Name:      mg.Name,
+				Checksum:  mg.checksum(),
+				AppliedAt: time.Now(),
+			}).Error
+		}
+		return tx.Table(m.opts.Table).Where("version = ?", mg.Version).Delete(&MigrationRecord{}).Error
+	})
+	if err != nil {
+		return fmt.Errorf("db: migration %s %s %s failed: %w", mg.Version, mg.Name, action, err)
+	}
+	log.Printf("[db] migration %s %s %s success, %s", mg.Version, mg.Name, action, time.Since(begin))
+	return nil
+}
+
+// dryRun 打印SQL, Go迁移在 DryRun 会话中执行, 打印生成的SQL
+func (m *Migrator) dryRun(db *gorm.DB, mg *Migration, query string, fn func(tx *gorm.DB) error, action string) error {
+	w := m.opts.Output
+	_, _ = fmt.Fprintf(w, "-- migration %s %s %s\n", mg.Version, mg.Name, action)
+	for _, stmt := range splitSQL(query) {
+		_, _ = fmt.Fprintf(w, "%s;\n", stmt)
+	}
+	if fn != nil {
+		tx := db.Session(&gorm.Session{DryRun: true, SkipDefaultTransaction: true, Logger: dryRunLogger{w: w}})
+		if err := fn(tx); err != nil {
+			return fmt.Errorf("db: migration %s %s %s dry run failed: %w", mg.Version, mg.Name, action, err)
+		}
+	}
+	return nil
+}
+
+// dryRunLogger 打印 DryRun 会话生成的SQL
+type dryRunLogger struct {
+	w io.Writer
+}
+
+func (l dryRunLogger) LogMode(logger.LogLevel) logger.Interface      { return l }
+func (l dryRunLogger) Info(context.Context, string, ...interface{})  {}
+func (l dryRunLogger) Warn(context.Context, string, ...interface{})  {}
+func (l dryRunLogger) Error(context.Context, string, ...interface{}) {}
+func (l dryRunLogger) Trace(_ context.Context, _ time.Time, fc func() (string, int64), _ error) {
+	sql, _ := fc()
+	_, _ = fmt.Fprintf(l.w, "%s;\n", sql)
+}
+
+// splitSQL 按分隔符拆分多条SQL, 默认分隔符为分号, 忽略引号和注释中的分隔符
+// 支持mysql客户端的 DELIMITER 命令, 存储过程和触发器的 BEGIN ... END 中可以使用分号
+// /*! ... */ 可执行注释和 /*+ ... */ 优化器提示原样保留, 其他注释删除
+func splitSQL(query string) []string {
+	var (
+		list  []string
+		buf   strings.Builder
+		quote byte
+		delim = ";"
+	)
+	flush := func() {
+		if s := strings.TrimSpace(buf.String()); s != "" {
+			list = append(list, s)
+		}
+		buf.Reset()
+	}
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			buf.WriteByte(c)
+			if c == '\\' && quote != '`' && i+1 < len(query) {
+				i++
+				buf.WriteByte(query[i])
+			} else if c == quote {
+				quote = 0
+			}
+		case lineStart(query, i) && isDelimiterCmd(query[i:]):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			fields := strings.Fields(query[i : i+end])
+			if len(fields) > 1 {
+				flush()
+				delim = fields[1]
+			}
+			i += end
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			buf.WriteByte(c)
+		case c == '-' && strings.HasPrefix(query[i:], "-- "), c == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+			buf.WriteByte('\n')
+		case c == '/' && (strings.HasPrefix(query[i:], "/*!") || strings.HasPrefix(query[i:], "/*+")):
+			end := strings.Index(query[i+3:], "*/")
+			if end < 0 {
+				buf.WriteString(query[i:])
+				i = len(query)
+			} else {
+				buf.WriteString(query[i : i+end+5])
+				i += end + 4
+			}
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += end + 3
+			}
+			buf.WriteByte(' ')
+		case strings.HasPrefix(query[i:], delim):
+			flush()
+			i += len(delim) - 1
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	flush()
+	return list
+}
+
+// lineStart i之前到行首只有空白
+func lineStart(query string, i int) bool {
+	for j := i - 1; j >= 0; j-- {
+		switch query[j] {
+		case '\n':
+			return true
+		case ' ', '\t', '\r':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isDelimiterCmd 是否为 DELIMITER 命令, 不区分大小写
+func isDelimiterCmd(s string) bool {
+	const cmd = "delimiter"
+	return len(s) > len(cmd) && strings.EqualFold(s[:len(cmd)], cmd) && (s[len(cmd)] == ' ' || s[len(cmd)] == '\t')
+}
@@ -0,0 +1,101 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitSQL(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{
+			name:  "semicolon",
+			query: "CREATE TABLE a (id int);\nINSERT INTO a VALUES (1);",
+			want:  []string{"CREATE TABLE a (id int)", "INSERT INTO a VALUES (1)"},
+		},
+		{
+			name:  "no trailing semicolon",
+			query: "SELECT 1;\nSELECT 2",
+			want:  []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			name:  "quoted semicolon",
+			query: `INSERT INTO a VALUES ('a;b', "c;d", 'it\'s;');SELECT 1;`,
+			want:  []string{`INSERT INTO a VALUES ('a;b', "c;d", 'it\'s;')`, "SELECT 1"},
+		},
+		{
+			name:  "backtick",
+			query: "CREATE TABLE `a;b` (id int);",
+			want:  []string{"CREATE TABLE `a;b` (id int)"},
+		},
+		{
+			name:  "line comments",
+			query: "-- create;\nSELECT 1; # trailing;\n-- end",
+			want:  []string{"SELECT 1"},
+		},
+		{
+			name:  "block comment",
+			query: "SELECT /* a; b */ 1;",
+			want:  []string{"SELECT   1"},
+		},
+		{
+			name:  "executable comment",
+			query: "/*!40101 SET NAMES utf8mb4 */;\nSELECT /*+ MAX_EXECUTION_TIME(1000) */ 1;",
+			want:  []string{"/*!40101 SET NAMES utf8mb4 */", "SELECT /*+ MAX_EXECUTION_TIME(1000) */ 1"},
+		},
+		{
+			name: "delimiter",
+			query: "DROP PROCEDURE IF EXISTS p;\n" +
+				"DELIMITER $$\n" +
+				"CREATE PROCEDURE p()\nBEGIN\n  SELECT 1;\n  SELECT 2;\nEND$$\n" +
+				"delimiter ;\n" +
+				"CALL p();",
+			want: []string{
+				"DROP PROCEDURE IF EXISTS p",
+				"CREATE PROCEDURE p()\nBEGIN\n  SELECT 1;\n  SELECT 2;\nEND",
+				"CALL p()",
+			},
+		},
+		{
+			name:  "delimiter not at line start",
+			query: "SELECT 'DELIMITER $$' AS delimiter;",
+			want:  []string{"SELECT 'DELIMITER $$' AS delimiter"},
+		},
+		{
+			name:  "empty",
+			query: " ;\n-- only comment\n",
+			want:  nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitSQL(tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitSQL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2", "10", true},
+		{"10", "2", false},
+		{"002", "10", true},
+		{"20220901120000", "20220901120001", true},
+		{"1", "1", false},
+		{"01", "1", true},
+		{"v2", "v10", false},
+		{"a", "b", true},
+	}
+	for _, tt := range tests {
+		if got := versionLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("versionLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/laydong/toolpkg/datax"
+	"github.com/laydong/toolpkg/logx"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxQueries      = 50
+	defaultMaxQueryTime    = time.Second
+	defaultRepeatThreshold = 10
+	queryStatsKey          = "__db_query_stats"
+)
+
+// QueryBudget 每个请求的查询预算, 超出时打印警告日志, 每个请求只警告一次
+// 为0的项使用默认值, 小于0不检查
+type QueryBudget struct {
+	MaxQueries      int           `json:"max_queries"`      // 查询次数, 默认50
+	MaxTime         time.Duration `json:"max_time"`         // 查询总耗时, 如 1s, 默认1秒
+	RepeatThreshold int           `json:"repeat_threshold"` // 同一形状的sql执行次数达到时视为N+1, 默认10
+}
+
+var currentBudget atomic.Value // QueryBudget
+
+// SetQueryBudget 设置请求的查询预算
+func SetQueryBudget(b QueryBudget) {
+	currentBudget.Store(b)
+}
+
+func getBudget() QueryBudget {
+	b, _ := currentBudget.Load().(QueryBudget)
+	if b.MaxQueries == 0 {
+		b.MaxQueries = defaultMaxQueries
+	}
+	if b.MaxTime == 0 {
+		b.MaxTime = defaultMaxQueryTime
+	}
+	if b.RepeatThreshold == 0 {
+		b.RepeatThreshold = defaultRepeatThreshold
+	}
+	return b
+}
+
+// queryStatsCtxKey 普通context中保存统计的key
+type queryStatsCtxKey struct{}
+
+// QueryStats 一个请求内的查询统计
+type QueryStats struct {
+	mu      sync.Mutex
+	count   int
+	elapsed time.Duration
+	shapes  map[string]int
+
+	overCount bool
+	overTime  bool
+}
+
+var queryStatsCreateLock sync.Mutex
+
+// WithQueryStats 开启查询统计
+// gin.Context、appx.Context、grpcx.GrpcContext 等 datax.DataContext 会在第一次查询时自动开启, 不需要调用
+func WithQueryStats(ctx context.Context) context.Context {
+	if st := getQueryStats(ctx, true); st != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, queryStatsCtxKey{}, newQueryStats())
+}
+
+func newQueryStats() *QueryStats {
+	return &QueryStats{shapes: map[string]int{}}
+}
+
+// GetQueryStats 获取ctx中的查询统计, 没有查询时返回nil
+func GetQueryStats(ctx context.Context) *QueryStats {
+	return getQueryStats(ctx, false)
+}
+
+func getQueryStats(ctx context.Context, create bool) *QueryStats {
+	if ctx == nil {
+		return nil
+	}
+	if st, ok := ctx.Value(queryStatsCtxKey{}).(*QueryStats); ok {
+		return st
+	}
+	if st, ok := ctx.Value(queryStatsKey).(*QueryStats); ok {
+		return st
+	}
+	dc, ok := ctx.(datax.DataContext)
+	if !ok || !create {
+		return nil
+	}
+
+	queryStatsCreateLock.Lock()
+	defer queryStatsCreateLock.Unlock()
+	if val, ok := dc.Get(queryStatsKey); ok {
+		if st, ok := val.(*QueryStats); ok {
+			return st
+		}
+	}
+	st := newQueryStats()
+	dc.Set(queryStatsKey, st)
+	return st
+}
+
+// Totals 查询次数和总耗时
+func (s *QueryStats) Totals() (count int, elapsed time.Duration) {
+	if s == nil {
+		return 0, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count, s.elapsed
+}
+
+var (
+	placeholderList = regexp.MustCompile(`\?(\s*,\s*\?)+`)
+	valuesList      = regexp.MustCompile(`\(\?\)(\s*,\s*\(\?\))+`)
+)
+
+// sqlShape 参数个数不同的 IN (?,?) 和多行 VALUES 视为相同的形状
+func sqlShape(sql string) string {
+	sql = placeholderList.ReplaceAllString(sql, "?")
+	return valuesList.ReplaceAllString(sql, "(?)")
+}
+
+// recordQuery 记录一次查询, 超出预算或出现N+1时打印警告
+func recordQuery(db *gorm.DB, elapsed time.Duration) {
+	ctx := db.Statement.Context
+	st := getQueryStats(ctx, true)
+	if st == nil {
+		return
+	}
+	sql := db.Statement.SQL.String()
+	if sql == "" {
+		return
+	}
+	shape := sqlShape(sql)
+	b := getBudget()
+
+	st.mu.Lock()
+	st.count++
+	st.elapsed += elapsed
+	st.shapes[shape]++
+	count, total, repeat := st.count, st.elapsed, st.shapes[shape]
+	overCount := b.MaxQueries > 0 && count > b.MaxQueries && !st.overCount
+	overTime := b.MaxTime > 0 && total > b.MaxTime && !st.overTime
+	st.overCount = st.overCount || overCount
+	st.overTime = st.overTime || overTime
+	st.mu.Unlock()
+
+	if overCount || overTime {
+		logx.Warn("db query budget exceeded",
+			zap.String(logx.RequestIdKey, logx.RequestIdFromContext(ctx)),
+			zap.String(logx.MessageType, "db_log"),
+			zap.Int("db_queries", count),
+			zap.String("db_time", formatMs(total)),
+			zap.Int("max_queries", b.MaxQueries),
+			zap.String("max_time", b.MaxTime.String()),
+		)
+	}
+	if b.RepeatThreshold > 0 && repeat == b.RepeatThreshold {
+		logx.Warn("db n+1 query detected",
+			zap.String(logx.RequestIdKey, logx.RequestIdFromContext(ctx)),
+			zap.String(logx.MessageType, "db_log"),
+			zap.String("sql", shape),
+			zap.Int("repeat", repeat),
+			zap.String("line", callerLine("gorm.io/")),
+		)
+	}
+}
+
+func formatMs(d time.Duration) string {
+	return fmt.Sprintf("%.3fms", float64(d.Nanoseconds())/1e6)
+}
+
+var dbSourceDir string
+
+func init() {
+	_, file, _, _ := runtime.Caller(0)
+	dbSourceDir = filepath.Dir(file) + string(filepath.Separator)
+}
+
+// callerLine 调用方的代码行, 跳过db包和路径包含skip的文件
+func callerLine(skip string) string {
+	for i := 2; i < 30; i++ {
+		_, file, line, ok := runtime.Caller(i)
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(file, dbSourceDir) || strings.Contains(file, skip) {
+			continue
+		}
+		return file + ":" + strconv.Itoa(line)
+	}
+	return ""
+}
@@ -2,40 +2,197 @@ package db
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"github.com/go-redis/redis/v8"
+	"os"
+	"time"
 )
 
 const (
 	defaultRedisPoolMinIdle = 2 // 连接池空闲连接数量
+
+	RdbModeStandalone = "standalone" // 单节点
+	RdbModeSentinel   = "sentinel"   // 哨兵, 自动切换主节点
+	RdbModeCluster    = "cluster"    // 集群
 )
 
-// InitRdb 初始化redis
+// RdbConf redis配置, Mode为空时按配置推断: 设置了 MasterName 为 sentinel, 多个地址为 cluster, 否则为 standalone
+// 为0的项使用go-redis的默认值
+type RdbConf struct {
+	Mode             string   `json:"mode"`              // standalone/sentinel/cluster
+	Addrs            []string `json:"addrs"`             // standalone为节点地址, sentinel为哨兵地址, cluster为种子节点地址
+	MasterName       string   `json:"master_name"`       // sentinel的主节点名称
+	Username         string   `json:"username"`          // ACL用户名
+	Password         string   `json:"password"`          // 密码
+	SentinelUsername string   `json:"sentinel_username"` // 哨兵的用户名
+	SentinelPassword string   `json:"sentinel_password"` // 哨兵的密码, 为空时哨兵不需要认证
+	DB               int      `json:"db"`                // DB 库, cluster不支持
+
+	PoolSize     int           `json:"pool_size"`      // 每个节点的连接数, 默认 10*CPU数
+	MinIdleConns int           `json:"min_idle_conns"` // 空闲连接数, 默认2
+	DialTimeout  time.Duration `json:"dial_timeout"`   // 建立连接超时, 如 5s, 默认5秒
+	ReadTimeout  time.Duration `json:"read_timeout"`   // 读超时, 默认3秒
+	WriteTimeout time.Duration `json:"write_timeout"`  // 写超时, 默认等于读超时
+	PoolTimeout  time.Duration `json:"pool_timeout"`   // 等待空闲连接超时, 默认读超时+1秒
+	IdleTimeout  time.Duration `json:"idle_timeout"`   // 空闲连接关闭时间, 默认5分钟
+
+	MaxRetries      int           `json:"max_retries"`       // 命令失败重试次数, 默认3, -1不重试
+	MinRetryBackoff time.Duration `json:"min_retry_backoff"` // 重试最小间隔, 默认8ms
+	MaxRetryBackoff time.Duration `json:"max_retry_backoff"` // 重试最大间隔, 默认512ms
+
+	ReadOnly       bool `json:"read_only"`        // cluster只读命令发往从节点
+	RouteByLatency bool `json:"route_by_latency"` // cluster只读命令发往延迟最低的节点, 会开启 ReadOnly
+
+	TLS TLSConf `json:"tls"` // TLS配置
+
+	SlowThreshold time.Duration `json:"slow_threshold"` // 慢命令阈值, 超过时redis_log使用warn级别, 默认100ms, 小于0不检查
+}
+
+// TLSConf redis和mongodb的TLS配置
+type TLSConf struct {
+	Enable             bool   `json:"enable"`               // 开启TLS
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"` // 不校验服务端证书, 仅用于测试
+	ServerName         string `json:"server_name"`          // 校验证书使用的域名, 默认为连接地址
+	CaFile             string `json:"ca_file"`              // CA证书, 为空时使用系统证书
+	CertFile           string `json:"cert_file"`            // 客户端证书, 服务端要求双向认证时使用
+	KeyFile            string `json:"key_file"`             // 客户端私钥
+}
+
+// RdbTLSConf redis TLS配置, 与mongodb共用 TLSConf
+//
+// Deprecated: use TLSConf.
+type RdbTLSConf = TLSConf
+
+// InitRdb 初始化单节点redis
 //addr string "127.0.0.1:6379"
 //password  密码 可传空
 //num int DB 库
 func InitRdb(addr, password string, num int) (db *redis.Client, err error) {
-	options := redis.Options{
-		Addr:     addr,
+	rdb, err := NewRdb(RdbConf{
+		Mode:     RdbModeStandalone,
+		Addrs:    []string{addr},
 		Password: password,
 		DB:       num,
+	})
+	if rdb != nil {
+		db = rdb.(*redis.Client)
+	}
+	return
+}
+
+// NewRdb 按配置初始化单节点、哨兵或集群redis, 连接失败时返回客户端和错误
+// 客户端会记录 redis_log 日志和链路, 见 rdbHook
+func NewRdb(conf RdbConf) (db redis.UniversalClient, err error) {
+	if len(conf.Addrs) == 0 {
+		return nil, errors.New("redis addrs is empty")
+	}
+	options := &redis.UniversalOptions{
+		Addrs:            conf.Addrs,
+		DB:               conf.DB,
+		Username:         conf.Username,
+		Password:         conf.Password,
+		SentinelUsername: conf.SentinelUsername,
+		SentinelPassword: conf.SentinelPassword,
+		MasterName:       conf.MasterName,
+		MaxRetries:       conf.MaxRetries,
+		MinRetryBackoff:  conf.MinRetryBackoff,
+		MaxRetryBackoff:  conf.MaxRetryBackoff,
+		DialTimeout:      conf.DialTimeout,
+		ReadTimeout:      conf.ReadTimeout,
+		WriteTimeout:     conf.WriteTimeout,
+		PoolSize:         conf.PoolSize,
+		MinIdleConns:     conf.MinIdleConns,
+		PoolTimeout:      conf.PoolTimeout,
+		IdleTimeout:      conf.IdleTimeout,
+		ReadOnly:         conf.ReadOnly,
+		RouteByLatency:   conf.RouteByLatency,
 	}
 	if options.MinIdleConns == 0 {
 		options.MinIdleConns = defaultRedisPoolMinIdle
 	}
-	db = redis.NewClient(&options)
-	_, err = db.Ping(context.Background()).Result()
-	if err == redis.Nil {
-		return
-	} else if err != nil {
-		return
+	if conf.TLS.Enable {
+		if options.TLSConfig, err = tlsConfig("redis", conf.TLS); err != nil {
+			return nil, err
+		}
+	}
+
+	switch rdbMode(conf) {
+	case RdbModeSentinel:
+		if conf.MasterName == "" {
+			return nil, errors.New("redis sentinel master_name is empty")
+		}
+		db = redis.NewFailoverClient(options.Failover())
+	case RdbModeCluster:
+		if conf.DB != 0 {
+			return nil, errors.New("redis cluster does not support db")
+		}
+		db = redis.NewClusterClient(options.Cluster())
+	case RdbModeStandalone:
+		db = redis.NewClient(options.Simple())
+	default:
+		return nil, fmt.Errorf("redis mode %s not supported", conf.Mode)
 	}
+	db.AddHook(newRdbHook(conf))
 	err = RdbSurvive(db)
 	return
 }
 
-// RdbSurvive redis存活检测
-func RdbSurvive(db *redis.Client) error {
-	err := db.Ping(context.Background()).Err()
+// rdbMode 未设置模式时按配置推断
+func rdbMode(conf RdbConf) string {
+	if conf.Mode != "" {
+		return conf.Mode
+	}
+	if conf.MasterName != "" {
+		return RdbModeSentinel
+	}
+	if len(conf.Addrs) > 1 {
+		return RdbModeCluster
+	}
+	return RdbModeStandalone
+}
+
+// tlsConfig 按配置生成tls.Config, name用于错误信息
+func tlsConfig(name string, conf TLSConf) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         conf.ServerName,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+	if conf.CaFile != "" {
+		ca, err := os.ReadFile(conf.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s tls ca_file read failed: %w", name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("%s tls ca_file %s has no certificate", name, conf.CaFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s tls cert load failed: %w", name, err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// RdbSurvive redis存活检测, 集群模式检测所有主节点
+func RdbSurvive(db redis.UniversalClient) error {
+	ctx := context.Background()
+	var err error
+	if cluster, ok := db.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return client.Ping(ctx).Err()
+		})
+	} else {
+		err = db.Ping(ctx).Err()
+	}
 	if err == redis.Nil {
 		return nil
 	}
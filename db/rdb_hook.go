@@ -0,0 +1,200 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/laydong/toolpkg/logx"
+	"github.com/laydong/toolpkg/tracex"
+	"github.com/laydong/toolpkg/utils"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRedisSlowThreshold = 100 * time.Millisecond
+	redisPipelineMaxCmds      = 50 // 管道日志最多记录的命令数
+)
+
+// rdbHookKey context中保存命令开始时间和span的key
+type rdbHookKey struct{}
+
+type rdbHookState struct {
+	begin     time.Time
+	requestId string
+	quiet     bool // 后台轮询, 见 utils.WithQuietLog
+	span      opentracing.Span
+}
+
+// redisBlockingCmds 阻塞等待的命令, 耗时取决于超时参数, 不检查慢命令
+var redisBlockingCmds = map[string]bool{
+	"blpop":      true,
+	"brpop":      true,
+	"brpoplpush": true,
+	"blmove":     true,
+	"blmpop":     true,
+	"bzpopmin":   true,
+	"bzpopmax":   true,
+	"bzmpop":     true,
+	"wait":       true,
+}
+
+// rdbHook 每条命令和每个管道开启子span, 执行后写 redis_log, 超过慢命令阈值时使用warn级别
+// 阻塞命令不检查慢命令, 后台轮询的命令成功时使用debug级别
+type rdbHook struct {
+	addr          string
+	slowThreshold time.Duration
+}
+
+func newRdbHook(conf RdbConf) *rdbHook {
+	h := &rdbHook{addr: strings.Join(conf.Addrs, ","), slowThreshold: conf.SlowThreshold}
+	if h.slowThreshold == 0 {
+		h.slowThreshold = defaultRedisSlowThreshold
+	}
+	return h
+}
+
+func (h *rdbHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return h.before(ctx, "redis:"+cmd.Name()), nil
+}
+
+func (h *rdbHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.after(ctx, cmd.Name(), cmdKey(cmd), nil, isBlocking(cmd), cmd.Err())
+	return nil
+}
+
+func (h *rdbHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return h.before(ctx, "redis:pipeline"), nil
+}
+
+func (h *rdbHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	names := make([]string, 0, len(cmds))
+	var err error
+	for i, cmd := range cmds {
+		if i < redisPipelineMaxCmds {
+			names = append(names, strings.TrimSpace(cmd.Name()+" "+cmdKey(cmd)))
+		}
+		if e := cmd.Err(); err == nil && e != nil && e != redis.Nil {
+			err = e
+		}
+	}
+	h.after(ctx, "pipeline", "", names, false, err)
+	return nil
+}
+
+// before 链路和请求ID在开始时从原始ctx读取, 返回的ctx是派生的, 不一定能取到
+func (h *rdbHook) before(ctx context.Context, name string) context.Context {
+	st := &rdbHookState{begin: time.Now(), requestId: logx.RequestIdFromContext(ctx), quiet: utils.IsQuietLog(ctx)}
+	if tc := tracex.FromContext(ctx); tc != nil {
+		if span := tc.ChildSpan(name, ext.SpanKindRPCClient); span != nil {
+			ext.DBType.Set(span, "redis")
+			ext.Component.Set(span, "go-redis")
+			ext.PeerAddress.Set(span, h.addr)
+			st.span = span
+		}
+	}
+	return context.WithValue(ctx, rdbHookKey{}, st)
+}
+
+func (h *rdbHook) after(ctx context.Context, name, key string, pipeline []string, blocking bool, err error) {
+	st, ok := ctx.Value(rdbHookKey{}).(*rdbHookState)
+	if !ok {
+		return
+	}
+	if errors.Is(err, redis.Nil) {
+		err = nil
+	}
+	end := time.Now()
+	elapsed := end.Sub(st.begin)
+
+	if st.span != nil {
+		statement := strings.TrimSpace(name + " " + key)
+		if len(pipeline) > 0 {
+			statement = strings.Join(pipeline, "\n")
+		}
+		ext.DBStatement.Set(st.span, statement)
+		if err != nil {
+			ext.Error.Set(st.span, true)
+			st.span.LogKV("error", err.Error())
+		}
+		st.span.Finish()
+	}
+
+	requestId := st.requestId
+	if requestId == "" {
+		requestId = "null"
+	}
+	request := redisRequestLog{Addr: h.addr, Cmd: name, Key: key, Pipeline: pipeline, Line: callerLine("github.com/go-redis/")}
+	var errMsg string
+	if err != nil {
+		errMsg = err.Error()
+	}
+	fields := []interface{}{
+		zap.Any("datetime", st.begin.Format(logx.TimeFormat)),
+		zap.String(logx.MessageType, "redis_log"),
+		zap.String(logx.RequestIdKey, requestId),
+		zap.Any("request", request),
+		zap.String("respon", errMsg),
+		zap.Any("start_time", float64(st.begin.UnixNano())/1e9),
+		zap.Any("end_time", float64(end.UnixNano())/1e9),
+		zap.String("run_time", formatMs(elapsed)),
+	}
+	switch {
+	case err != nil:
+		logx.Error("redis_log", fields...)
+	case !blocking && h.slowThreshold > 0 && elapsed >= h.slowThreshold:
+		request.SlowLog = fmt.Sprintf("SLOW REDIS >= %v", h.slowThreshold)
+		fields[3] = zap.Any("request", request)
+		logx.Warn("redis_log", fields...)
+	case st.quiet:
+		logx.Debug("redis_log", fields...)
+	default:
+		logx.Info("redis_log", fields...)
+	}
+}
+
+type redisRequestLog struct {
+	Addr     string   `json:"addr"`
+	Cmd      string   `json:"cmd"`
+	Key      string   `json:"key"`
+	Pipeline []string `json:"pipeline,omitempty"`
+	SlowLog  string   `json:"slow_log"`
+	Line     string   `json:"line"`
+}
+
+// isBlocking 是否为阻塞命令, XREAD 和 XREADGROUP 带有 BLOCK 参数时阻塞
+func isBlocking(cmd redis.Cmder) bool {
+	name := strings.ToLower(cmd.Name())
+	if redisBlockingCmds[name] {
+		return true
+	}
+	if name != "xread" && name != "xreadgroup" {
+		return false
+	}
+	for _, arg := range cmd.Args()[1:] {
+		s, ok := arg.(string)
+		if !ok {
+			continue
+		}
+		if strings.EqualFold(s, "streams") {
+			break
+		}
+		if strings.EqualFold(s, "block") {
+			return true
+		}
+	}
+	return false
+}
+
+// cmdKey 命令的第一个参数, 大多数命令为key
+func cmdKey(cmd redis.Cmder) string {
+	args := cmd.Args()
+	if len(args) < 2 {
+		return ""
+	}
+	return fmt.Sprint(args[1])
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"gorm.io/gorm"
+	"log"
+	"sort"
+	"sync"
+)
+
+// DefaultDBName 默认实例名称, InitDB 注册的实例以及 GetDB 不传名称时使用
+const DefaultDBName = "default"
+
+// dbInstance 一个注册的mysql实例, 持有主库和从库的连接池用于健康检查和关闭
+type dbInstance struct {
+	conf     DbConf
+	db       *gorm.DB
+	source   *sql.DB
+	replicas []*replica
+	prober   *replicaProber
+}
+
+var (
+	dbLock sync.RWMutex
+	dbs    = map[string]*dbInstance{}
+)
+
+// RegisterDB 按配置打开实例并以 conf.Name 注册, 名称重复时返回错误
+// 主库不可用时返回错误, 从库不可用时只打印日志, 默认实例同时赋值给 DB
+func RegisterDB(conf DbConf) (*gorm.DB, error) {
+	return registerDB(conf, false)
+}
+
+// registerDB replace为true时替换同名实例, 旧实例停止健康检查, 连接池不关闭, 仍在使用旧DB的调用方不受影响
+func registerDB(conf DbConf, replace bool) (*gorm.DB, error) {
+	if conf.Name == "" {
+		conf.Name = DefaultDBName
+	}
+	dbLock.RLock()
+	_, existed := dbs[conf.Name]
+	dbLock.RUnlock()
+	if existed && !replace {
+		return nil, fmt.Errorf("db: %s already registered", conf.Name)
+	}
+
+	ins, err := openDB(conf)
+	if err != nil {
+		return nil, fmt.Errorf("db: open %s failed: %w", conf.Name, err)
+	}
+	if err = ins.source.Ping(); err != nil {
+		_ = ins.close()
+		return nil, fmt.Errorf("db: %s source ping failed: %w", conf.Name, err)
+	}
+	// 从库不可用时先移出轮询, 由健康检查恢复, 没有开启健康检查时不移出
+	for i, r := range ins.replicas {
+		if e := r.pool.Ping(); e != nil {
+			log.Printf("[db] %s replica %d unavailable: %s", conf.Name, i, e.Error())
+			if ins.prober != nil {
+				r.healthy = 0
+			}
+		}
+	}
+	if ins.prober != nil {
+		ins.prober.start()
+	}
+
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	if old, ok := dbs[conf.Name]; ok {
+		if !replace {
+			_ = ins.close()
+			return nil, fmt.Errorf("db: %s already registered", conf.Name)
+		}
+		if old.prober != nil {
+			old.prober.stop()
+		}
+	}
+	dbs[conf.Name] = ins
+	if conf.Name == DefaultDBName {
+		DB = ins.db
+	}
+	return ins.db, nil
+}
+
+// LookupDB 按名称获取注册的实例
+func LookupDB(name string) (*gorm.DB, error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	ins, ok := dbs[name]
+	if !ok {
+		return nil, fmt.Errorf("db: %s not registered", name)
+	}
+	return ins.db, nil
+}
+
+// DBNames 获取所有注册的实例名称
+func DBNames() []string {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	names := make([]string, 0, len(dbs))
+	for name := range dbs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CloseDB 关闭实例的主库和从库连接池并取消注册
+func CloseDB(name string) error {
+	dbLock.Lock()
+	ins, ok := dbs[name]
+	delete(dbs, name)
+	if ok && name == DefaultDBName {
+		DB = nil
+	}
+	dbLock.Unlock()
+	if !ok {
+		return nil
+	}
+	return ins.close()
+}
+
+// CloseAllDB 关闭所有注册的实例
+func CloseAllDB() (err error) {
+	for _, name := range DBNames() {
+		if e := CloseDB(name); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// DbSurviveAll 检查所有注册实例的主库和从库, 返回不可用的实例及原因, 全部可用时返回空map
+func DbSurviveAll() map[string]error {
+	dbLock.RLock()
+	list := make(map[string]*dbInstance, len(dbs))
+	for name, ins := range dbs {
+		list[name] = ins
+	}
+	dbLock.RUnlock()
+
+	result := make(map[string]error)
+	for name, ins := range list {
+		if err := ins.survive(); err != nil {
+			result[name] = err
+		}
+	}
+	return result
+}
+
+// survive 检查主库和所有从库
+func (ins *dbInstance) survive() error {
+	if err := ins.source.Ping(); err != nil {
+		return fmt.Errorf("source ping failed: %w", err)
+	}
+	for i, r := range ins.replicas {
+		if err := r.pool.Ping(); err != nil {
+			return fmt.Errorf("replica %d ping failed: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (ins *dbInstance) close() (err error) {
+	if ins.prober != nil {
+		ins.prober.stop()
+	}
+	pools := []*sql.DB{ins.source}
+	for _, r := range ins.replicas {
+		pools = append(pools, r.pool)
+	}
+	for _, pool := range pools {
+		if pool == nil {
+			continue
+		}
+		if e := pool.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
@@ -0,0 +1,367 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+	"reflect"
+)
+
+const (
+	defaultPageSize      = 20
+	maxPageSize          = 1000
+	defaultVersionColumn = "version"
+)
+
+// ErrVersionConflict 乐观锁更新失败, 记录已经被修改或删除
+var ErrVersionConflict = errors.New("db: version conflict")
+
+var deletedAtType = reflect.TypeOf(gorm.DeletedAt{})
+
+// PageQuery 分页参数, 可以直接绑定请求参数
+type PageQuery struct {
+	Page     int `json:"page" form:"page"`           // 从1开始
+	PageSize int `json:"page_size" form:"page_size"` // 默认20, 最大1000
+}
+
+// CursorQuery 游标分页参数, 第一页 Cursor 为空, 之后使用上一页返回的 NextCursor
+type CursorQuery struct {
+	Cursor   string `json:"cursor" form:"cursor"`
+	PageSize int    `json:"page_size" form:"page_size"`
+}
+
+// Page 分页结果, 可以直接作为 utils.OkWithData 的数据返回
+// 游标分页不统计 Total, Page 为0
+type Page[T any] struct {
+	List       []T    `json:"list"`
+	Total      int64  `json:"total"`
+	Page       int    `json:"page"`
+	PageSize   int    `json:"page_size"`
+	HasMore    bool   `json:"has_more"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// RepoOptions 仓库选项
+type RepoOptions struct {
+	DBName        string // 实例名称, 默认 default
+	VersionColumn string // 乐观锁的版本列, 默认 version, 模型没有这一列时不使用乐观锁
+	CursorColumn  string // 游标分页的列, 默认主键, 需要唯一且不为空
+	CursorAsc     bool   // 游标分页是否正序, 默认倒序
+}
+
+type RepoOptionFunc func(*RepoOptions)
+
+// WithRepoDB 使用指定实例
+func WithRepoDB(name string) RepoOptionFunc {
+	return func(o *RepoOptions) {
+		o.DBName = name
+	}
+}
+
+// WithVersionColumn 设置乐观锁的版本列, 为空时不使用乐观锁
+func WithVersionColumn(column string) RepoOptionFunc {
+	return func(o *RepoOptions) {
+		o.VersionColumn = column
+	}
+}
+
+// WithCursorColumn 设置游标分页的列和顺序
+func WithCursorColumn(column string, asc bool) RepoOptionFunc {
+	return func(o *RepoOptions) {
+		o.CursorColumn = column
+		o.CursorAsc = asc
+	}
+}
+
+// Repository 模型T的通用增删改查, T为gorm模型结构体
+// 通过 GetDB 获取连接, 事务、读写分离、链路追踪和 GetDB 一致
+// 模型包含 gorm.DeletedAt 字段时 Delete 为软删除, 查询自动排除已删除的记录, 使用 WithDeleted 包含
+type Repository[T any] struct {
+	opts RepoOptions
+}
+
+// NewRepository 创建仓库
+func NewRepository[T any](opts ...RepoOptionFunc) *Repository[T] {
+	o := RepoOptions{
+		DBName:        DefaultDBName,
+		VersionColumn: defaultVersionColumn,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+	return &Repository[T]{opts: o}
+}
+
+// DB 获取模型T的查询, 用于仓库没有提供的查询
+func (r *Repository[T]) DB(ctx context.Context) *gorm.DB {
+	return GetDB(ctx, r.opts.DBName).Model(new(T))
+}
+
+// query 立即执行scopes, 分页时可以检查排序并复用条件
+func (r *Repository[T]) query(ctx context.Context, scopes []func(*gorm.DB) *gorm.DB) *gorm.DB {
+	tx := r.DB(ctx)
+	for _, scope := range scopes {
+		tx = scope(tx)
+	}
+	return tx
+}
+
+// Get 按主键查询, 不存在时返回 gorm.ErrRecordNotFound
+func (r *Repository[T]) Get(ctx context.Context, id interface{}, scopes ...func(*gorm.DB) *gorm.DB) (*T, error) {
+	var t T
+	err := r.query(ctx, scopes).Where(clause.Eq{Column: clause.PrimaryColumn, Value: id}).Take(&t).Error
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// First 查询第一条, 不存在时返回 gorm.ErrRecordNotFound
+func (r *Repository[T]) First(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) (*T, error) {
+	var t T
+	if err := r.query(ctx, scopes).Take(&t).Error; err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Find 查询列表
+//
+//	list, err := repo.Find(ctx, db.Filter(req), db.OrderBy(req.Order))
+func (r *Repository[T]) Find(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) ([]T, error) {
+	list := make([]T, 0)
+	if err := r.query(ctx, scopes).Find(&list).Error; err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Count 查询数量
+func (r *Repository[T]) Count(ctx context.Context, scopes ...func(*gorm.DB) *gorm.DB) (total int64, err error) {
+	err = r.query(ctx, scopes).Count(&total).Error
+	return
+}
+
+// FindPage 按页码分页, scopes中没有排序时按主键排序
+func (r *Repository[T]) FindPage(ctx context.Context, q PageQuery, scopes ...func(*gorm.DB) *gorm.DB) (*Page[T], error) {
+	q.Page, q.PageSize = normalizePage(q.Page, q.PageSize)
+	result := &Page[T]{List: make([]T, 0), Page: q.Page, PageSize: q.PageSize}
+
+	tx := r.query(ctx, scopes).Session(&gorm.Session{})
+	if err := tx.Count(&result.Total).Error; err != nil {
+		return nil, err
+	}
+	offset := (q.Page - 1) * q.PageSize
+	if result.Total <= int64(offset) {
+		return result, nil
+	}
+
+	if _, ok := tx.Statement.Clauses["ORDER BY"]; !ok {
+		if sch, err := r.schema(tx); err == nil && sch.PrioritizedPrimaryField != nil {
+			tx = tx.Order(clause.OrderByColumn{Column: clause.PrimaryColumn})
+		}
+	}
+	if err := tx.Offset(offset).Limit(q.PageSize).Find(&result.List).Error; err != nil {
+		return nil, err
+	}
+	result.HasMore = result.Total > int64(offset+len(result.List))
+	return result, nil
+}
+
+// FindCursor 按游标分页, 翻页不受新增数据影响且不统计总数, 适合大表和无限滚动
+// 按游标列排序, scopes中不要再排序
+func (r *Repository[T]) FindCursor(ctx context.Context, q CursorQuery, scopes ...func(*gorm.DB) *gorm.DB) (*Page[T], error) {
+	_, q.PageSize = normalizePage(1, q.PageSize)
+	result := &Page[T]{List: make([]T, 0), PageSize: q.PageSize}
+
+	tx := r.query(ctx, scopes)
+	sch, err := r.schema(tx)
+	if err != nil {
+		return nil, err
+	}
+	field := sch.PrioritizedPrimaryField
+	if r.opts.CursorColumn != "" {
+		field = sch.LookUpField(r.opts.CursorColumn)
+	}
+	if field == nil {
+		return nil, fmt.Errorf("db: %s cursor column %s not found", sch.Name, r.opts.CursorColumn)
+	}
+
+	col := clause.Column{Table: clause.CurrentTable, Name: field.DBName}
+	if q.Cursor != "" {
+		value, err := decodeCursor(q.Cursor, field)
+		if err != nil {
+			return nil, err
+		}
+		if r.opts.CursorAsc {
+			tx = tx.Where(clause.Gt{Column: col, Value: value})
+		} else {
+			tx = tx.Where(clause.Lt{Column: col, Value: value})
+		}
+	}
+	err = tx.Order(clause.OrderByColumn{Column: col, Desc: !r.opts.CursorAsc}).
+		Limit(q.PageSize + 1).Find(&result.List).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.List) > q.PageSize {
+		result.List = result.List[:q.PageSize]
+		result.HasMore = true
+		last := reflect.ValueOf(&result.List[q.PageSize-1]).Elem()
+		value, _ := field.ValueOf(ctx, last)
+		if result.NextCursor, err = encodeCursor(value); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Create 新增
+func (r *Repository[T]) Create(ctx context.Context, entity *T) error {
+	return GetDB(ctx, r.opts.DBName).Create(entity).Error
+}
+
+// CreateBatch 批量新增, 每batchSize条一个insert, 默认100
+func (r *Repository[T]) CreateBatch(ctx context.Context, list []T, batchSize int) error {
+	if len(list) == 0 {
+		return nil
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	return GetDB(ctx, r.opts.DBName).CreateInBatches(list, batchSize).Error
+}
+
+// Update 按主键更新, fields为空时更新除创建时间和删除时间外的所有字段(包括零值), 否则只更新fields
+// 模型有版本列时使用乐观锁: 只更新版本未变化的记录并将版本加1, 没有更新时返回 ErrVersionConflict 且不修改entity的版本
+func (r *Repository[T]) Update(ctx context.Context, entity *T, fields ...string) error {
+	tx := GetDB(ctx, r.opts.DBName)
+	sch, err := r.schema(tx)
+	if err != nil {
+		return err
+	}
+	rv := reflect.ValueOf(entity).Elem()
+	if sch.PrioritizedPrimaryField == nil {
+		return fmt.Errorf("db: %s has no primary key", sch.Name)
+	}
+	if _, zero := sch.PrioritizedPrimaryField.ValueOf(ctx, rv); zero {
+		return fmt.Errorf("db: update %s without primary key", sch.Name)
+	}
+
+	version := r.versionField(sch)
+	tx = tx.Model(entity)
+	if len(fields) > 0 {
+		if version != nil {
+			fields = append(fields, version.DBName)
+		}
+		tx = tx.Select(fields)
+	} else {
+		var omits []string
+		for _, f := range sch.Fields {
+			if f.AutoCreateTime > 0 || f.FieldType == deletedAtType {
+				omits = append(omits, f.DBName)
+			}
+		}
+		tx = tx.Select("*").Omit(omits...)
+	}
+	if version == nil {
+		return tx.Updates(entity).Error
+	}
+
+	fv := version.ReflectValueOf(ctx, rv)
+	old := reflect.New(fv.Type()).Elem()
+	old.Set(fv)
+	switch fv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fv.SetInt(fv.Int() + 1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		fv.SetUint(fv.Uint() + 1)
+	default:
+		return fmt.Errorf("db: %s version column %s must be integer", sch.Name, version.DBName)
+	}
+
+	res := tx.Where(clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: version.DBName}, Value: old.Interface()}).
+		Updates(entity)
+	if res.Error == nil && res.RowsAffected == 0 {
+		res.Error = ErrVersionConflict
+	}
+	if res.Error != nil {
+		fv.Set(old)
+	}
+	return res.Error
+}
+
+// Delete 按主键删除, 模型包含 gorm.DeletedAt 时为软删除, 没有删除记录时返回 gorm.ErrRecordNotFound
+func (r *Repository[T]) Delete(ctx context.Context, id interface{}) error {
+	return r.delete(GetDB(ctx, r.opts.DBName), id)
+}
+
+// ForceDelete 按主键物理删除, 包括已经软删除的记录
+func (r *Repository[T]) ForceDelete(ctx context.Context, id interface{}) error {
+	return r.delete(GetDB(ctx, r.opts.DBName).Unscoped(), id)
+}
+
+func (r *Repository[T]) delete(tx *gorm.DB, id interface{}) error {
+	res := tx.Where(clause.Eq{Column: clause.PrimaryColumn, Value: id}).Delete(new(T))
+	if res.Error == nil && res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return res.Error
+}
+
+// schema 解析模型T, 结果由gorm缓存
+func (r *Repository[T]) schema(tx *gorm.DB) (*schema.Schema, error) {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(new(T)); err != nil {
+		return nil, err
+	}
+	return stmt.Schema, nil
+}
+
+func (r *Repository[T]) versionField(sch *schema.Schema) *schema.Field {
+	if r.opts.VersionColumn == "" {
+		return nil
+	}
+	return sch.LookUpField(r.opts.VersionColumn)
+}
+
+func normalizePage(page, size int) (int, int) {
+	if page < 1 {
+		page = 1
+	}
+	if size <= 0 {
+		size = defaultPageSize
+	}
+	if size > maxPageSize {
+		size = maxPageSize
+	}
+	return page, size
+}
+
+// encodeCursor 游标为列值的json, 使用base64避免在url中转义
+func encodeCursor(value interface{}) (string, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeCursor 按列的类型解析游标, 避免大整数精度丢失
+func decodeCursor(cursor string, field *schema.Field) (interface{}, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("db: invalid cursor %s", cursor)
+	}
+	ptr := reflect.New(field.FieldType)
+	if err = json.Unmarshal(b, ptr.Interface()); err != nil {
+		return nil, fmt.Errorf("db: invalid cursor %s", cursor)
+	}
+	return ptr.Elem().Interface(), nil
+}
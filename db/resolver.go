@@ -0,0 +1,220 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"gorm.io/gorm"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 从库选择策略
+const (
+	PolicyRandom       = "random"        // 随机
+	PolicyWeighted     = "weighted"      // 按权重随机
+	PolicyRoundRobin   = "round_robin"   // 轮询
+	PolicyLeastLatency = "least_latency" // 选择健康检查延迟最低且繁忙连接最少的从库
+
+	defaultProbeInterval = 5 * time.Second // 从库健康检查间隔
+	latencyDecay         = 0.3             // 延迟平滑系数, 新的延迟所占比例
+)
+
+// replica 一个从库及其健康状态
+type replica struct {
+	dsn     string
+	pool    *sql.DB
+	weight  int
+	healthy int32 // 1健康 0不健康
+	latency int64 // 平滑后的ping延迟, 纳秒
+	lag     int64 // 复制延迟, 纳秒, -1表示未知
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+// replicaPolicy 实现 dbresolver.Policy, 只在健康的从库中选择, 所有从库都不健康时使用主库
+// dbresolver 只有一个从库时不会调用Policy, 所以注册时会把主库也放在从库列表的最后, 只作为兜底使用
+type replicaPolicy struct {
+	policy   string
+	source   *sql.DB
+	replicas map[gorm.ConnPool]*replica
+	counter  uint64
+
+	rndLock sync.Mutex
+	rnd     *rand.Rand
+}
+
+func newReplicaPolicy(policy string, source *sql.DB, replicas []*replica) (*replicaPolicy, error) {
+	switch policy {
+	case "":
+		policy = PolicyRandom
+	case PolicyRandom, PolicyWeighted, PolicyRoundRobin, PolicyLeastLatency:
+	default:
+		return nil, fmt.Errorf("unknown replica policy %s", policy)
+	}
+
+	p := &replicaPolicy{
+		policy:   policy,
+		source:   source,
+		replicas: make(map[gorm.ConnPool]*replica, len(replicas)),
+		rnd:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, r := range replicas {
+		p.replicas[r.pool] = r
+	}
+	return p, nil
+}
+
+// Resolve 选择一个从库
+func (p *replicaPolicy) Resolve(connPools []gorm.ConnPool) gorm.ConnPool {
+	healthy := make([]*replica, 0, len(connPools))
+	for _, pool := range connPools {
+		if r, ok := p.replicas[pool]; ok && r.isHealthy() {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return p.source
+	}
+
+	switch p.policy {
+	case PolicyWeighted:
+		return p.weighted(healthy).pool
+	case PolicyRoundRobin:
+		n := atomic.AddUint64(&p.counter, 1)
+		return healthy[(n-1)%uint64(len(healthy))].pool
+	case PolicyLeastLatency:
+		return leastLatency(healthy).pool
+	default:
+		return healthy[p.intn(len(healthy))].pool
+	}
+}
+
+func (p *replicaPolicy) intn(n int) int {
+	p.rndLock.Lock()
+	defer p.rndLock.Unlock()
+	return p.rnd.Intn(n)
+}
+
+func (p *replicaPolicy) weighted(list []*replica) *replica {
+	total := 0
+	for _, r := range list {
+		total += r.weight
+	}
+	n := p.intn(total)
+	for _, r := range list {
+		if n < r.weight {
+			return r
+		}
+		n -= r.weight
+	}
+	return list[len(list)-1]
+}
+
+// leastLatency 按 延迟*(繁忙连接数+1) 选择, 避免所有请求都压到同一个从库
+func leastLatency(list []*replica) *replica {
+	var (
+		best  *replica
+		score float64
+	)
+	for _, r := range list {
+		s := float64(atomic.LoadInt64(&r.latency)+1) * float64(r.pool.Stats().InUse+1)
+		if best == nil || s < score {
+			best, score = r, s
+		}
+	}
+	return best
+}
+
+// replicaProber 定时检查从库, 失败的从库移出轮询, 恢复后重新加入
+// 开启延迟检查时同时更新从库的复制延迟, 获取失败时延迟为未知, 不影响健康状态
+type replicaProber struct {
+	name     string
+	interval time.Duration
+	replicas []*replica
+	lag      lagChecker
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newReplicaProber(name string, interval time.Duration, replicas []*replica, lag lagChecker) *replicaProber {
+	return &replicaProber{
+		name:     name,
+		interval: interval,
+		replicas: replicas,
+		lag:      lag,
+		done:     make(chan struct{}),
+	}
+}
+
+func (rp *replicaProber) start() {
+	go func() {
+		if rp.lag != nil {
+			rp.probe()
+		}
+		ticker := time.NewTicker(rp.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rp.done:
+				return
+			case <-ticker.C:
+				rp.probe()
+			}
+		}
+	}()
+}
+
+func (rp *replicaProber) stop() {
+	rp.once.Do(func() {
+		close(rp.done)
+	})
+}
+
+// probe 检查所有从库, 状态变化时打印日志
+func (rp *replicaProber) probe() {
+	for i, r := range rp.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), rp.interval)
+		begin := time.Now()
+		err := r.pool.PingContext(ctx)
+		cost := int64(time.Since(begin))
+		if err == nil && rp.lag != nil {
+			rp.updateLag(ctx, i, r)
+		}
+		cancel()
+
+		if err != nil {
+			atomic.StoreInt64(&r.lag, -1)
+			if atomic.CompareAndSwapInt32(&r.healthy, 1, 0) {
+				log.Printf("[db] %s replica %d removed: %s", rp.name, i, err.Error())
+			}
+			continue
+		}
+
+		old := atomic.LoadInt64(&r.latency)
+		if old == 0 {
+			atomic.StoreInt64(&r.latency, cost)
+		} else {
+			atomic.StoreInt64(&r.latency, int64(float64(old)*(1-latencyDecay)+float64(cost)*latencyDecay))
+		}
+		if atomic.CompareAndSwapInt32(&r.healthy, 0, 1) {
+			log.Printf("[db] %s replica %d restored", rp.name, i)
+		}
+	}
+}
+
+func (rp *replicaProber) updateLag(ctx context.Context, i int, r *replica) {
+	lag, err := rp.lag(ctx, r.pool)
+	if err != nil {
+		if atomic.SwapInt64(&r.lag, -1) != -1 {
+			log.Printf("[db] %s replica %d lag unknown: %s", rp.name, i, err.Error())
+		}
+		return
+	}
+	atomic.StoreInt64(&r.lag, int64(lag))
+}
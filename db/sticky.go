@@ -0,0 +1,209 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/laydong/toolpkg/datax"
+	"gorm.io/gorm"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 从库延迟检查方式
+const (
+	LagReplicaStatus = "replica_status" // 在从库执行 SHOW REPLICA STATUS, 秒级精度
+	LagHeartbeat     = "heartbeat"      // 读取从库heartbeat表中主库最后写入的时间, 如 pt-heartbeat, 表需要有 ts 列
+
+	defaultHeartbeatTable = "heartbeat"
+	stickyKey             = "__db_sticky"
+)
+
+var tableNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.]+$`)
+
+// stickyCtxKey 普通context中保存写入时间的key
+type stickyCtxKey struct{}
+
+// stickyState 一个请求在各个实例上最后一次写入的时间
+type stickyState struct {
+	mu     sync.Mutex
+	writes map[string]time.Time
+}
+
+var stickyCreateLock sync.Mutex
+
+// WithReadYourWrites 开启读写一致: 写入后 StickyWindow 内的查询使用主库
+// gin.Context、appx.Context、grpcx.GrpcContext 等 datax.DataContext 会在第一次写入时自动开启, 不需要调用
+// 普通context需要调用后使用返回的context, 由它派生的context共享写入时间
+// 由 DataContext 派生的普通context(如 context.WithTimeout)只能共享派生前已经开启的状态, 可以在派生前调用
+func WithReadYourWrites(ctx context.Context) context.Context {
+	if st := getSticky(ctx, true); st != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, stickyCtxKey{}, newStickyState())
+}
+
+func newStickyState() *stickyState {
+	return &stickyState{writes: map[string]time.Time{}}
+}
+
+// getSticky 获取context中的写入状态, create为true且ctx是DataContext时自动创建
+func getSticky(ctx context.Context, create bool) *stickyState {
+	if ctx == nil {
+		return nil
+	}
+	if st, ok := ctx.Value(stickyCtxKey{}).(*stickyState); ok {
+		return st
+	}
+	// appx.Context、grpcx.GrpcContext、gin.Context 的 Value 支持读取 DataContext 中的数据, 由它们派生的context也可以读到
+	if st, ok := ctx.Value(stickyKey).(*stickyState); ok {
+		return st
+	}
+	dc, ok := ctx.(datax.DataContext)
+	if !ok || !create {
+		return nil
+	}
+
+	stickyCreateLock.Lock()
+	defer stickyCreateLock.Unlock()
+	if val, ok := dc.Get(stickyKey); ok {
+		if st, ok := val.(*stickyState); ok {
+			return st
+		}
+	}
+	st := newStickyState()
+	dc.Set(stickyKey, st)
+	return st
+}
+
+// markWrite 记录实例的写入时间
+func markWrite(ctx context.Context, name string) {
+	st := getSticky(ctx, true)
+	if st == nil {
+		return
+	}
+	st.mu.Lock()
+	st.writes[name] = time.Now()
+	st.mu.Unlock()
+}
+
+// sinceWrite 距离上一次写入实例的时间
+func sinceWrite(ctx context.Context, name string) (time.Duration, bool) {
+	st := getSticky(ctx, false)
+	if st == nil {
+		return 0, false
+	}
+	st.mu.Lock()
+	t, ok := st.writes[name]
+	st.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	return time.Since(t), true
+}
+
+func (ins *dbInstance) stickyWindow() time.Duration {
+	if ins.conf.StickyWindow > 0 {
+		return ins.conf.StickyWindow
+	}
+	return dbWriteTime
+}
+
+// replicaOf 判断连接池是否是从库, 主库和事务返回false
+func (ins *dbInstance) replicaOf(pool gorm.ConnPool) (*replica, bool) {
+	for _, r := range ins.replicas {
+		if gorm.ConnPool(r.pool) == pool {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// safeSince 从库延迟小于距离写入的时间时, 从库已经包含了这次写入
+func (r *replica) safeSince(since time.Duration) bool {
+	lag := atomic.LoadInt64(&r.lag)
+	return lag >= 0 && time.Duration(lag) < since
+}
+
+// lagChecker 获取从库延迟
+type lagChecker func(ctx context.Context, pool *sql.DB) (time.Duration, error)
+
+func newLagChecker(mode, table string) (lagChecker, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case LagReplicaStatus:
+		return replicaStatusLag, nil
+	case LagHeartbeat:
+		if table == "" {
+			table = defaultHeartbeatTable
+		}
+		if !tableNameRegexp.MatchString(table) {
+			return nil, fmt.Errorf("invalid heartbeat table %s", table)
+		}
+		query := "SELECT TIMESTAMPDIFF(MICROSECOND, MAX(ts), NOW(6)) FROM " + table
+		return func(ctx context.Context, pool *sql.DB) (time.Duration, error) {
+			var us sql.NullInt64
+			if err := pool.QueryRowContext(ctx, query).Scan(&us); err != nil {
+				return 0, err
+			}
+			if !us.Valid {
+				return 0, fmt.Errorf("heartbeat table %s is empty", table)
+			}
+			if us.Int64 < 0 {
+				return 0, nil
+			}
+			return time.Duration(us.Int64) * time.Microsecond, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown lag mode %s", mode)
+}
+
+// replicaStatusLag 读取 Seconds_Behind_Source, 低版本使用 SHOW SLAVE STATUS 和 Seconds_Behind_Master
+// 只有秒级精度, 结果加1秒, 复制中断时返回错误
+func replicaStatusLag(ctx context.Context, pool *sql.DB) (time.Duration, error) {
+	rows, err := pool.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		rows, err = pool.QueryContext(ctx, "SHOW SLAVE STATUS")
+		if err != nil {
+			return 0, err
+		}
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("not a replica")
+	}
+	values := make([]sql.RawBytes, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err = rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+	for i, col := range cols {
+		if col != "Seconds_Behind_Source" && col != "Seconds_Behind_Master" {
+			continue
+		}
+		if values[i] == nil {
+			return 0, fmt.Errorf("replication is not running")
+		}
+		sec, err := strconv.ParseInt(string(values[i]), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(sec+1) * time.Second, nil
+	}
+	return 0, fmt.Errorf("seconds behind source not found")
+}
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"github.com/laydong/toolpkg/datax"
+	"gorm.io/gorm"
+	"log"
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTxRetries = 3                     // 死锁和锁等待超时的默认重试次数
+	defaultTxBackoff = 50 * time.Millisecond // 第一次重试前的等待时间, 之后每次翻倍
+	txKeyPrefix      = "__db_tx:"
+
+	errLockWaitTimeout = 1205
+	errDeadlock        = 1213
+)
+
+// TxOptions 事务选项
+type TxOptions struct {
+	Name       string         // 实例名称, 默认 default
+	MaxRetries int            // 死锁和锁等待超时时整个事务的重试次数, 小于0不重试
+	Backoff    time.Duration  // 第一次重试前的等待时间, 之后每次翻倍并加上随机抖动
+	SqlOptions *sql.TxOptions // 隔离级别和只读
+}
+
+type TxOptionFunc func(*TxOptions)
+
+// WithTxDB 在指定实例上开启事务
+func WithTxDB(name string) TxOptionFunc {
+	return func(o *TxOptions) {
+		o.Name = name
+	}
+}
+
+// WithTxRetry 设置重试次数和第一次重试前的等待时间, retries小于0不重试
+func WithTxRetry(retries int, backoff time.Duration) TxOptionFunc {
+	return func(o *TxOptions) {
+		o.MaxRetries = retries
+		if backoff > 0 {
+			o.Backoff = backoff
+		}
+	}
+}
+
+// WithTxSqlOptions 设置隔离级别和只读, 嵌套事务忽略
+func WithTxSqlOptions(opts *sql.TxOptions) TxOptionFunc {
+	return func(o *TxOptions) {
+		o.SqlOptions = opts
+	}
+}
+
+var savepointSeq uint64
+
+// txCtxKey 普通context中保存事务的key
+type txCtxKey struct {
+	name string
+}
+
+// txState 一层事务, 嵌套的事务对应一个savepoint
+type txState struct {
+	tx *gorm.DB
+
+	mu    sync.Mutex
+	hooks []func()
+}
+
+func (s *txState) addHook(fn func()) {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, fn)
+	s.mu.Unlock()
+}
+
+func (s *txState) takeHooks() []func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hooks := s.hooks
+	s.hooks = nil
+	return hooks
+}
+
+// Transaction 在事务中执行fn, fn返回error或panic时回滚, 否则提交
+// 事务会保存到ctx中, 事务执行期间 GetDB(ctx) 和嵌套的 Transaction(ctx, ...) 都会使用这个事务, 嵌套的事务使用savepoint
+// tx 绑定了保存事务的context, 由 tx.Statement.Context 派生的context同样可以取到事务
+// 最外层事务遇到死锁或锁等待超时时会整体重试, fn需要可以重复执行
+// ctx 为 appx.Context、grpcx.GrpcContext、gin.Context 等 DataContext 时, 事务执行期间不要在其他goroutine中使用同一个ctx访问同一个实例
+func Transaction(ctx context.Context, fn func(tx *gorm.DB) error, opts ...TxOptionFunc) (err error) {
+	o := TxOptions{
+		Name:       DefaultDBName,
+		MaxRetries: defaultTxRetries,
+		Backoff:    defaultTxBackoff,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if parent := getTx(ctx, o.Name); parent != nil {
+		return nestedTransaction(ctx, o.Name, parent, fn)
+	}
+
+	db, err := LookupDB(o.Name)
+	if err != nil {
+		return err
+	}
+	base := db.Set(gormContextKey, ctx).WithContext(ctx)
+	for attempt := 0; ; attempt++ {
+		state := &txState{}
+		err = base.Transaction(func(tx *gorm.DB) error {
+			return runInTx(ctx, o.Name, state, tx, fn)
+		}, sqlOptions(o.SqlOptions)...)
+		if err == nil {
+			runHooks(state.takeHooks())
+			return nil
+		}
+		if attempt >= o.MaxRetries || !IsRetryableTxError(err) {
+			return err
+		}
+
+		wait := o.Backoff << uint(attempt)
+		wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		log.Printf("[db] transaction on %s retry %d after %s: %s", o.Name, attempt+1, wait, err.Error())
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// nestedTransaction 嵌套事务使用savepoint, 失败只回滚到savepoint, 成功时after commit钩子交给外层事务
+// 不使用gorm的嵌套事务, 它按函数地址命名savepoint, 多层嵌套时名称会重复
+func nestedTransaction(ctx context.Context, name string, parent *txState, fn func(tx *gorm.DB) error) (err error) {
+	spName := fmt.Sprintf("sp_%d", atomic.AddUint64(&savepointSeq, 1))
+	tx := parent.tx.WithContext(ctx)
+	if err = tx.SavePoint(spName).Error; err != nil {
+		return
+	}
+
+	panicked := true
+	defer func() {
+		if panicked || err != nil {
+			tx.RollbackTo(spName)
+		}
+	}()
+	state := &txState{}
+	err = runInTx(ctx, name, state, tx, fn)
+	panicked = false
+	if err != nil {
+		return
+	}
+	for _, hook := range state.takeHooks() {
+		parent.addHook(hook)
+	}
+	return
+}
+
+// runInTx 将事务保存到ctx后执行fn, fn结束后恢复ctx中原来的事务
+func runInTx(ctx context.Context, name string, state *txState, tx *gorm.DB, fn func(tx *gorm.DB) error) error {
+	state.tx = tx
+	if dc, ok := ctx.(datax.DataContext); ok {
+		key := txKeyPrefix + name
+		prev, _ := dc.Get(key)
+		dc.Set(key, state)
+		defer dc.Set(key, prev)
+	}
+	txCtx := context.WithValue(ctx, txCtxKey{name: name}, state)
+	return fn(tx.WithContext(txCtx))
+}
+
+// getTx 获取ctx中正在执行的事务
+func getTx(ctx context.Context, name string) *txState {
+	if ctx == nil {
+		return nil
+	}
+	if name == "" {
+		name = DefaultDBName
+	}
+	if st, ok := ctx.Value(txCtxKey{name: name}).(*txState); ok && st != nil {
+		return st
+	}
+	if st, ok := ctx.Value(txKeyPrefix + name).(*txState); ok && st != nil {
+		return st
+	}
+	return nil
+}
+
+// AfterCommit 注册事务提交后执行的钩子, 事务回滚或savepoint回滚时钩子不会执行
+// ctx中没有事务时立即执行
+func AfterCommit(ctx context.Context, fn func(), dbName ...string) {
+	name := DefaultDBName
+	if len(dbName) > 0 && dbName[0] != "" {
+		name = dbName[0]
+	}
+	if st := getTx(ctx, name); st != nil {
+		st.addHook(fn)
+		return
+	}
+	runHooks([]func(){fn})
+}
+
+// runHooks 依次执行钩子, 单个钩子panic不影响其他钩子
+func runHooks(hooks []func()) {
+	for _, hook := range hooks {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("[db] after commit hook panic: %v\n%s", r, debug.Stack())
+				}
+			}()
+			hook()
+		}()
+	}
+}
+
+// IsRetryableTxError 是否是可以重试整个事务的错误: 死锁(1213)和锁等待超时(1205)
+func IsRetryableTxError(err error) bool {
+	var me *mysql.MySQLError
+	if errors.As(err, &me) {
+		return me.Number == errDeadlock || me.Number == errLockWaitTimeout
+	}
+	return false
+}
+
+func sqlOptions(opts *sql.TxOptions) []*sql.TxOptions {
+	if opts == nil {
+		return nil
+	}
+	return []*sql.TxOptions{opts}
+}
@@ -0,0 +1,44 @@
+package grpcx
+
+import (
+	"context"
+	"github.com/laydong/toolpkg/datax"
+	"github.com/laydong/toolpkg/metautils"
+	"github.com/laydong/toolpkg/utils"
+	"google.golang.org/grpc"
+)
+
+// Dial 创建grpc客户端连接, 默认带上传递request_id和baggage的拦截器
+func Dial(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append([]grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(UnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(StreamClientInterceptor),
+	}, opts...)
+	return grpc.Dial(target, opts...)
+}
+
+// UnaryClientInterceptor 调用方的拦截器, 将ctx中的request_id和baggage写入metadata
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(outgoingContext(ctx), method, req, reply, cc, opts...)
+}
+
+// StreamClientInterceptor 流式调用方的拦截器, 与 UnaryClientInterceptor 相同
+func StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(outgoingContext(ctx), desc, cc, method, opts...)
+}
+
+// outgoingContext 已经手动设置的metadata不会被覆盖
+func outgoingContext(ctx context.Context) context.Context {
+	md := metautils.ExtractOutgoing(ctx).Clone()
+	set := func(k, v string) {
+		if md.Get(k) == "" {
+			md.Set(k, v)
+		}
+	}
+
+	if logId, ok := ctx.Value(utils.RequestIdKey).(string); ok && logId != "" {
+		set(utils.RequestIdKey, logId)
+	}
+	datax.InjectBaggage(ctx, set)
+	return md.ToOutgoing(ctx)
+}
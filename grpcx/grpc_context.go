@@ -1,6 +1,7 @@
 package grpcx
 
 import (
+	"context"
 	"github.com/laydong/toolpkg/alarmx"
 	"github.com/laydong/toolpkg/datax"
 	"github.com/laydong/toolpkg/logx"
@@ -11,8 +12,9 @@ import (
 	"time"
 )
 
-// GrpcContext grpc context
+// GrpcContext 包装了grpc请求的context, 携带客户端传来的超时和取消
 type GrpcContext struct {
+	parent context.Context
 	server *GrpcServer
 
 	*logx.LogContext
@@ -21,34 +23,86 @@ type GrpcContext struct {
 	*alarmx.AlarmContext
 }
 
-// NewGrpcContext newCtx
+var _ context.Context = &GrpcContext{}
+
+// NewGrpcContext 创建没有超时和取消的 grpc context, 需要继承grpc请求的超时和取消时使用 NewGrpcContextWithParent
 func NewGrpcContext(name string, md metautils.NiceMD) *GrpcContext {
+	return NewGrpcContextWithParent(context.Background(), name, md)
+}
+
+// NewGrpcContextWithParent 基于grpc请求的原始context创建, ctx的超时、取消和值都会被继承
+func NewGrpcContextWithParent(ctx context.Context, name string, md metautils.NiceMD) *GrpcContext {
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	logId := md.Get(utils.RequestIdKey)
 	if logId == "" {
 		logId = utils.Md5(uuid.NewV4().String())
 	}
 
 	c := &GrpcContext{
+		parent:        ctx,
 		LogContext:    logx.NewLogContext(logId),
 		TraceContext:  tracex.NewTraceContext(name, md),
 		MemoryContext: datax.NewMemoryContext(),
 	}
 	c.Set(utils.RequestIdKey, logId)
+	c.Set(tracex.TraceContextKey, c.TraceContext)
+	datax.ExtractBaggage(c.MemoryContext, md.Get)
 	return c
 }
 
+// WithCancel 派生一个可以取消的context, 日志、链路和数据与当前context共享
+func (c *GrpcContext) WithCancel() (*GrpcContext, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.getParent())
+	return c.withParent(ctx), cancel
+}
+
+// WithTimeout 派生一个带超时的context, 日志、链路和数据与当前context共享
+func (c *GrpcContext) WithTimeout(timeout time.Duration) (*GrpcContext, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(c.getParent(), timeout)
+	return c.withParent(ctx), cancel
+}
+
+// WithDeadline 派生一个带截止时间的context, 日志、链路和数据与当前context共享
+func (c *GrpcContext) WithDeadline(d time.Time) (*GrpcContext, context.CancelFunc) {
+	ctx, cancel := context.WithDeadline(c.getParent(), d)
+	return c.withParent(ctx), cancel
+}
+
+// WithScope 派生一个使用子数据作用域的context, 可以读到当前context的数据, 写入不会影响当前context
+// 适合传给handler中启动的goroutine使用
+func (c *GrpcContext) WithScope() *GrpcContext {
+	tmp := *c
+	tmp.MemoryContext = c.MemoryContext.NewScope()
+	return &tmp
+}
+
+func (c *GrpcContext) withParent(parent context.Context) *GrpcContext {
+	tmp := *c
+	tmp.parent = parent
+	return &tmp
+}
+
+func (c *GrpcContext) getParent() context.Context {
+	if c.parent == nil {
+		return context.Background()
+	}
+	return c.parent
+}
+
 // Deadline returns the time when work done on behalf of this contextx
 // should be canceled. Deadline returns ok==false when no deadline is
 // set. Successive calls to Deadline return the same results.
 func (c *GrpcContext) Deadline() (deadline time.Time, ok bool) {
-	return
+	return c.getParent().Deadline()
 }
 
 // Done returns a channel that's closed when work done on behalf of this
 // contextx should be canceled. Done may return nil if this contextx can
 // never be canceled. Successive calls to Done return the same value.
 func (c *GrpcContext) Done() <-chan struct{} {
-	return nil
+	return c.getParent().Done()
 }
 
 // Err returns a non-nil error value after Done is closed,
@@ -58,16 +112,18 @@ func (c *GrpcContext) Done() <-chan struct{} {
 // Canceled if the contextx was canceled
 // or DeadlineExceeded if the contextx's deadline passed.
 func (c *GrpcContext) Err() error {
-	return nil
+	return c.getParent().Err()
 }
 
 // Value returns the value associated with this contextx for key, or nil
 // if no value is associated with key. Successive calls to Value with
 // the same key returns the same result.
+// string类型的key优先从 MemoryContext 中查找, 找不到再查找parent
 func (c *GrpcContext) Value(key interface{}) interface{} {
 	if keyAsString, ok := key.(string); ok {
-		val, _ := c.Get(keyAsString)
-		return val
+		if val, exists := c.Get(keyAsString); exists {
+			return val
+		}
 	}
-	return nil
+	return c.getParent().Value(key)
 }
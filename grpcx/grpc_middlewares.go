@@ -3,6 +3,7 @@ package grpcx
 import (
 	"context"
 	"encoding/json"
+	"github.com/laydong/toolpkg/datax"
 	"github.com/laydong/toolpkg/metautils"
 	"google.golang.org/grpc"
 )
@@ -11,7 +12,8 @@ import (
 func serverInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	// 初始化context
 	md := metautils.ExtractIncoming(ctx)
-	newCtx := NewGrpcContext(info.FullMethod, md)
+	newCtx := NewGrpcContextWithParent(ctx, info.FullMethod, md)
+	defer datax.ReleaseLoaderCache(newCtx.MemoryContext)
 
 	// 入参 header->meta
 	reqByte, _ := json.Marshal(req)
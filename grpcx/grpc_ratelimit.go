@@ -0,0 +1,72 @@
+package grpcx
+
+import (
+	"context"
+	"github.com/laydong/toolpkg/limitx"
+	"github.com/laydong/toolpkg/logx"
+	"github.com/laydong/toolpkg/metautils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+)
+
+// RateLimitKeyFunc 限流的key, 返回空时不限流
+type RateLimitKeyFunc func(ctx context.Context, info *grpc.UnaryServerInfo) string
+
+// RateLimitByMethod 按方法限流, 所有调用方共享一个方法的额度
+func RateLimitByMethod() RateLimitKeyFunc {
+	return func(ctx context.Context, info *grpc.UnaryServerInfo) string {
+		return "method:" + info.FullMethod
+	}
+}
+
+// RateLimitByPeer 按调用方IP限流
+func RateLimitByPeer() RateLimitKeyFunc {
+	return func(ctx context.Context, info *grpc.UnaryServerInfo) string {
+		p, ok := peer.FromContext(ctx)
+		if !ok || p.Addr == nil {
+			return ""
+		}
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		return "peer:" + host
+	}
+}
+
+// RateLimitByMetadata 按metadata限流, 如 app-key, 为空时不限流
+func RateLimitByMetadata(name string) RateLimitKeyFunc {
+	return func(ctx context.Context, info *grpc.UnaryServerInfo) string {
+		v := metautils.ExtractIncoming(ctx).Get(name)
+		if v == "" {
+			return ""
+		}
+		return "md:" + name + ":" + v
+	}
+}
+
+// RateLimitInterceptor 限流拦截器, 通过 GrpcServer.Use 注册, 超出额度时返回 ResourceExhausted
+// redis出错时放行并记录错误日志
+func RateLimitInterceptor(l *limitx.Limiter, key RateLimitKeyFunc) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		k := key(ctx, info)
+		if k == "" {
+			return handler(ctx, req)
+		}
+		res, err := l.Allow(ctx, k)
+		if err != nil {
+			logx.ErrorLogId(logx.RequestIdFromContext(ctx), "rate limit failed, key: %s, err: %s", k, err.Error())
+			return handler(ctx, req)
+		}
+		if !res.Allowed {
+			if res.RetryAfter > 0 {
+				return nil, status.Errorf(codes.ResourceExhausted, "rate limit exceeded, retry after %s", res.RetryAfter)
+			}
+			return nil, status.Error(codes.ResourceExhausted, "rate limit exceeded")
+		}
+		return handler(ctx, req)
+	}
+}
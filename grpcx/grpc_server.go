@@ -62,3 +62,10 @@ func (gs *GrpcServer) Run(addr string) (err error) {
 	err = gs.Server.Serve(lis)
 	return
 }
+
+// Stop 优雅停止服务, 等待处理中的请求结束
+func (gs *GrpcServer) Stop() {
+	if gs.Server != nil {
+		gs.Server.GracefulStop()
+	}
+}
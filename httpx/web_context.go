@@ -3,6 +3,7 @@ package httpx
 import (
 	"github.com/gin-gonic/gin"
 	"github.com/laydong/toolpkg/alarmx"
+	"github.com/laydong/toolpkg/datax"
 	"github.com/laydong/toolpkg/logx"
 	"github.com/laydong/toolpkg/tracex"
 	"github.com/laydong/toolpkg/utils"
@@ -36,6 +37,7 @@ func NewWebContext(ginContext *gin.Context) *WebContext {
 		ginContext.Request.Header.Set(utils.RequestIdKey, logId)
 		ginContext.Set(utils.RequestIdKey, logId)
 	}
+	datax.ExtractBaggage(ginContext, ginContext.GetHeader)
 
 	tmp := &WebContext{
 		Context:      ginContext,
@@ -43,6 +45,7 @@ func NewWebContext(ginContext *gin.Context) *WebContext {
 		TraceContext: tracex.NewTraceContext(ginContext.Request.RequestURI, ginContext.Request.Header),
 	}
 	ginContext.Set(ginFlag, tmp)
+	ginContext.Set(tracex.TraceContextKey, tmp.TraceContext)
 
 	return tmp
 }
@@ -2,9 +2,11 @@ package httpx
 
 import (
 	"bytes"
+	"github.com/laydong/toolpkg/datax"
 	"github.com/laydong/toolpkg/utils"
 	"io/ioutil"
 	"strings"
+	"sync"
 )
 
 // 不需要打印入参和出参的路由
@@ -19,8 +21,29 @@ type logParams struct {
 // NoLogParamsRules 不想打印的路由分组
 var NoLogParamsRules logParams
 
+var noLogParamsLock sync.RWMutex
+
+// SetNoLogParams 更新不需要打印入参和出参的路由, 可以在服务运行中调用
+// routes 完整路由, prefix 路由前缀, suffix 路由后缀
+func SetNoLogParams(routes, prefix, suffix []string) {
+	rules := logParams{
+		NoLogParams:       make(map[string]string, len(routes)),
+		NoLogParamsPrefix: prefix,
+		NoLogParamsSuffix: suffix,
+	}
+	for _, v := range routes {
+		rules.NoLogParams[v] = v
+	}
+
+	noLogParamsLock.Lock()
+	NoLogParamsRules = rules
+	noLogParamsLock.Unlock()
+}
+
 // CheckNoLogParams 判断是否需要打印入参出参日志, 不需要打印返回true
 func CheckNoLogParams(origin string) bool {
+	noLogParamsLock.RLock()
+	defer noLogParamsLock.RUnlock()
 	if len(NoLogParamsRules.NoLogParams) > 0 {
 		if _, ok := NoLogParamsRules.NoLogParams[origin]; ok {
 			return true
@@ -50,6 +73,7 @@ func CheckNoLogParams(origin string) bool {
 func ginInterceptor(ctx *WebContext) {
 	w := &responseBodyWriter{body: &bytes.Buffer{}, ResponseWriter: ctx.Writer}
 	ctx.Writer = w
+	defer datax.ReleaseLoaderCache(ctx.Context)
 	if !CheckNoLogParams(ctx.Request.RequestURI) {
 		requestData, _ := ctx.GetRawData()
 		ctx.Request.Body = ioutil.NopCloser(bytes.NewBuffer(requestData))
@@ -0,0 +1,191 @@
+package limitx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	uuid "github.com/satori/go.uuid"
+	"strconv"
+	"time"
+)
+
+const (
+	TokenBucket   = "token_bucket"   // 令牌桶, 允许 Burst 个请求的突发, 之后按速率放行
+	SlidingWindow = "sliding_window" // 滑动窗口, 任意 Period 时间内最多 Limit 个请求
+
+	defaultPrefix = "limitx:" // 限流key前缀
+)
+
+// 使用redis的时间, 多个副本之间不受本机时钟影响
+var (
+	tokenBucketScript = redis.NewScript(`
+if redis.replicate_commands then redis.replicate_commands() end
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * rate)
+end
+
+local allowed = 0
+local retry = 0
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+else
+	retry = math.ceil((n - tokens) / rate)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tokens, 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(capacity / rate) + 1000)
+return {allowed, math.floor(tokens), retry}`)
+
+	slidingWindowScript = redis.NewScript(`
+if redis.replicate_commands then redis.replicate_commands() end
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+if count + n <= limit then
+	for i = 1, n do
+		redis.call('ZADD', KEYS[1], now, ARGV[4] .. ':' .. i)
+	end
+	redis.call('PEXPIRE', KEYS[1], window)
+	return {1, limit - count - n, 0}
+end
+
+local retry = window
+if n <= limit then
+	local oldest = redis.call('ZRANGE', KEYS[1], count + n - limit - 1, count + n - limit - 1, 'WITHSCORES')
+	if oldest[2] then
+		retry = tonumber(oldest[2]) + window - now
+	end
+end
+return {0, math.max(limit - count, 0), retry}`)
+)
+
+// Rule 限流规则
+type Rule struct {
+	Algorithm string        `json:"algorithm"` // token_bucket/sliding_window, 默认 token_bucket
+	Limit     int           `json:"limit"`     // 每个 Period 放行的请求数
+	Period    time.Duration `json:"period"`    // 时间单位, 如 1s, 默认1秒
+	Burst     int           `json:"burst"`     // 令牌桶的容量, 默认等于 Limit, 滑动窗口不使用
+}
+
+// Result 限流结果
+type Result struct {
+	Allowed    bool          // 是否放行
+	Remaining  int           // 剩余可以放行的请求数
+	RetryAfter time.Duration // 被拒绝时多久之后可以重试, 请求数超过容量时为-1
+}
+
+// Options 限流器选项
+type Options struct {
+	Prefix string // key前缀, 默认 limitx:, 多个应用共用redis时用来区分
+}
+
+type OptionFunc func(*Options)
+
+// WithPrefix 设置key前缀
+func WithPrefix(prefix string) OptionFunc {
+	return func(o *Options) {
+		o.Prefix = prefix
+	}
+}
+
+// Limiter redis限流器, 多个副本共享同一个key的额度
+type Limiter struct {
+	rdb  redis.UniversalClient
+	rule Rule
+	opts Options
+}
+
+// NewLimiter 创建限流器, rdb 通常为 db.InitRdb 或 appx.App.Redis() 返回的客户端
+func NewLimiter(rdb redis.UniversalClient, rule Rule, opts ...OptionFunc) (*Limiter, error) {
+	if rdb == nil {
+		return nil, errors.New("limitx: redis is nil")
+	}
+	if rule.Algorithm == "" {
+		rule.Algorithm = TokenBucket
+	}
+	if rule.Algorithm != TokenBucket && rule.Algorithm != SlidingWindow {
+		return nil, fmt.Errorf("limitx: algorithm %s not supported", rule.Algorithm)
+	}
+	if rule.Limit <= 0 {
+		return nil, errors.New("limitx: limit must be greater than 0")
+	}
+	if rule.Period < time.Millisecond {
+		rule.Period = time.Second
+	}
+	if rule.Burst <= 0 {
+		rule.Burst = rule.Limit
+	}
+	o := Options{Prefix: defaultPrefix}
+	for _, f := range opts {
+		f(&o)
+	}
+	return &Limiter{rdb: rdb, rule: rule, opts: o}, nil
+}
+
+// Rule 限流规则
+func (l *Limiter) Rule() Rule {
+	return l.rule
+}
+
+// Allow 请求一次
+func (l *Limiter) Allow(ctx context.Context, key string) (Result, error) {
+	return l.AllowN(ctx, key, 1)
+}
+
+// AllowN 请求n次, 不足n次时不扣减额度
+func (l *Limiter) AllowN(ctx context.Context, key string, n int) (Result, error) {
+	if n <= 0 {
+		return Result{Allowed: true}, nil
+	}
+	var res []interface{}
+	var err error
+	if l.rule.Algorithm == SlidingWindow {
+		res, err = slidingWindowScript.Run(ctx, l.rdb, []string{l.opts.Prefix + "sw:" + key},
+			l.rule.Limit, l.rule.Period.Milliseconds(), n, uuid.NewV4().String()).Slice()
+	} else {
+		// 每毫秒生成的令牌数
+		rate := float64(l.rule.Limit) / float64(l.rule.Period.Milliseconds())
+		res, err = tokenBucketScript.Run(ctx, l.rdb, []string{l.opts.Prefix + "tb:" + key},
+			l.rule.Burst, strconv.FormatFloat(rate, 'f', -1, 64), n).Slice()
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	if len(res) != 3 {
+		return Result{}, fmt.Errorf("limitx: unexpected result %v", res)
+	}
+	allowed, _ := res[0].(int64)
+	remaining, _ := res[1].(int64)
+	retry, _ := res[2].(int64)
+	r := Result{Allowed: allowed == 1, Remaining: int(remaining), RetryAfter: time.Duration(retry) * time.Millisecond}
+	if !r.Allowed && n > l.capacity() {
+		r.RetryAfter = -1
+	}
+	return r, nil
+}
+
+func (l *Limiter) capacity() int {
+	if l.rule.Algorithm == SlidingWindow {
+		return l.rule.Limit
+	}
+	return l.rule.Burst
+}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/laydong/toolpkg"
+	"github.com/laydong/toolpkg/datax"
 	"github.com/laydong/toolpkg/logx"
 	"github.com/laydong/toolpkg/utils"
 	"go.uber.org/zap"
@@ -585,12 +586,21 @@ func (client *HttpClient) WithITrace(ctx *gin.Context) *HttpClient {
 			client.WithHeader(k, v)
 		}
 	}
+	client.WithBaggage(ctx)
 
 	client.WithHeader("Content-Type", "application/json")
 	client.cxt = ctx
 	return client
 }
 
+// WithBaggage 将ctx中标记为baggage的值(租户id、流量标记等)作为header发送
+func (client *HttpClient) WithBaggage(ctx context.Context) *HttpClient {
+	datax.InjectBaggage(ctx, func(header, value string) {
+		client.WithHeader(header, value)
+	})
+	return client
+}
+
 func (client *HttpClient) WithCommonHeader(appName, appSecretKey string) *HttpClient {
 	now := time.Now().Unix()
 	appSign := utils.Md5(fmt.Sprintf("%s%d", appSecretKey, now))
@@ -12,15 +12,60 @@ import (
 )
 
 // InitLog 初始化日志文件 logPath= /home/logs/app/appName/childPath
+// 重复调用会按新的配置重建日志, 可用于配置变更后切换日志路径和轮转规则
+// 重建时 Sugar 和 AuditSugar 不变, 只原子替换内部的core, 新core生效后才关闭旧的日志文件
 func InitLog(options *Config) {
 	//for _, f := range options {
 	//	f(DefaultConfig)
 	//}
-	Sugar = initSugar(options)
+	logLock.Lock()
+	defer logLock.Unlock()
+	oldWriter, oldAudit := fileWriter, auditWriter
+	core, audit := initSugar(options), initAudit(options)
+	if logCore == nil {
+		logCore, auditCore = newSwapCore(core), newSwapCore(audit)
+		Sugar, AuditSugar = zap.New(logCore), zap.New(auditCore)
+	} else {
+		_ = logCore.swap(core).Sync()
+		_ = auditCore.swap(audit).Sync()
+	}
+	if oldWriter != nil && oldWriter != fileWriter {
+		_ = oldWriter.Close()
+	}
+	if oldAudit != nil && oldAudit != auditWriter {
+		_ = oldAudit.Close()
+	}
+}
+
+// SetLevel 动态调整日志级别 debug/info/warn/error
+func SetLevel(level string) error {
+	l, err := parseLevel(level)
+	if err != nil {
+		return err
+	}
+	defaultLogLevel.SetLevel(l)
+	return nil
+}
+
+// GetLevel 获取当前的日志级别
+func GetLevel() string {
+	return defaultLogLevel.Level().String()
 }
 
-func initSugar(lc *Config) *zap.Logger {
-	loglevel := zapcore.InfoLevel
+func parseLevel(level string) (l zapcore.Level, err error) {
+	if level == "" {
+		level = DefaultLogLevel
+	}
+	err = l.UnmarshalText([]byte(level))
+	return
+}
+
+func initSugar(lc *Config) zapcore.Core {
+	loglevel, err := parseLevel(lc.LogLevel)
+	if err != nil {
+		log.Printf("[glogs_sugar] log level %s invalid, use %s", lc.LogLevel, DefaultLogLevel)
+		loglevel = zapcore.InfoLevel
+	}
 	defaultLogLevel.SetLevel(loglevel)
 
 	logPath := fmt.Sprintf("%s/%s/%s", lc.LogPath, lc.AppName, fmt.Sprintf(lc.ChildPath, time.Now().Format("2006-01-02")))
@@ -33,24 +78,24 @@ func initSugar(lc *Config) *zap.Logger {
 		configs.EncodeTime = timeEncoder
 
 		//w := zapcore.AddSync(GetWriter(logPath, lc))
+		fileWriter = &fileSink{w: newFileWriter(logPath, lc)}
 
 		core = zapcore.NewCore(
 			zapcore.NewJSONEncoder(configs),
-			GetWriteSyncer(logPath, lc),
+			zapcore.NewMultiWriteSyncer(zapcore.AddSync(os.Stdout), zapcore.AddSync(fileWriter)),
 			defaultLogLevel,
 		)
 		log.Printf("[glogs_sugar] log success")
 	} else {
 		// 打印在控制台
+		fileWriter = nil
 		consoleEncoder := zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
 		core = zapcore.NewCore(consoleEncoder, zapcore.Lock(os.Stdout), defaultLogLevel)
 		log.Printf("[glogs_sugar] log success")
 	}
 
-	filed := zap.Fields(zap.String("app_name", lc.AppName), zap.String("app_mode", lc.AppMode))
 	//return zap.New(core, filed, zap.AddCaller(), zap.AddCallerSkip(3))
-	return zap.New(core, filed)
-	//Sugar = logger.Sugar()
+	return core.With([]zapcore.Field{zap.String("app_name", lc.AppName), zap.String("app_mode", lc.AppMode)})
 
 }
 
@@ -126,6 +171,12 @@ func Error(template string, args ...interface{}) {
 	writer(nil, Sugar, LevelError, msg, LevelError, fields...)
 }
 
+// Debug 调试日志, 默认的info级别下不输出
+func Debug(template string, args ...interface{}) {
+	msg, fields := dealWithArgs(template, args...)
+	writers(Sugar, LevelDebug, msg, fields...)
+}
+
 func Info(template string, args ...interface{}) {
 	msg, fields := dealWithArgs(template, args...)
 	writers(Sugar, LevelInfo, msg, fields...)
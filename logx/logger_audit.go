@@ -0,0 +1,50 @@
+package logx
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"log"
+	"os"
+	"time"
+)
+
+// initAudit 审计日志单独写入文件, 级别固定为info, 不受 SetLevel 影响
+func initAudit(lc *Config) zapcore.Core {
+	var core zapcore.Core
+	if lc.LogType == "file" {
+		auditPath := lc.AuditPath
+		if auditPath == "" {
+			auditPath = DefaultAuditPath
+		}
+		configs := zap.NewProductionEncoderConfig()
+		configs.EncodeTime = timeEncoder
+		logPath := fmt.Sprintf("%s/%s/%s", lc.LogPath, lc.AppName, fmt.Sprintf(auditPath, time.Now().Format("2006-01-02")))
+		auditWriter = &fileSink{w: newFileWriter(logPath, lc)}
+		core = zapcore.NewCore(zapcore.NewJSONEncoder(configs), zapcore.AddSync(auditWriter), zapcore.InfoLevel)
+	} else {
+		auditWriter = nil
+		consoleEncoder := zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+		core = zapcore.NewCore(consoleEncoder, zapcore.Lock(os.Stdout), zapcore.InfoLevel)
+	}
+	log.Printf("[glogs_sugar] audit log success")
+	return core.With([]zapcore.Field{zap.String("app_name", lc.AppName), zap.String("app_mode", lc.AppMode)})
+}
+
+// Audit 写审计日志, 未初始化日志时写入标准输出
+func Audit(requestId string, fields ...Field) {
+	if requestId == "" {
+		requestId = "null"
+	}
+	fields = append(fields,
+		zap.Any("datetime", time.Now().Format(TimeFormat)),
+		zap.String(RequestIdKey, requestId),
+		zap.String(MessageType, "audit_log"),
+	)
+	logger := AuditSugar
+	if logger == nil {
+		writer(nil, Sugar, LevelInfo, "audit_log", "audit", fields...)
+		return
+	}
+	logger.Info("audit_log", fields...)
+}
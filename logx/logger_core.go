@@ -0,0 +1,96 @@
+package logx
+
+import (
+	"errors"
+	"github.com/natefinch/lumberjack"
+	"go.uber.org/zap/zapcore"
+	"sync"
+	"sync/atomic"
+)
+
+var errLogClosed = errors.New("logx: log file closed")
+
+// swapCore 可替换内部core的core, 重建日志时只替换core, Sugar 和 AuditSugar 不变, 读取时不需要加锁
+type swapCore struct {
+	cur    *atomic.Value   // coreHolder
+	fields []zapcore.Field // With 添加的字段, 替换core后仍然生效
+}
+
+// coreHolder atomic.Value 要求每次存入相同的类型
+type coreHolder struct {
+	core zapcore.Core
+}
+
+func newSwapCore(core zapcore.Core) *swapCore {
+	v := &atomic.Value{}
+	v.Store(coreHolder{core: core})
+	return &swapCore{cur: v}
+}
+
+// swap 替换core, 返回旧的core
+func (c *swapCore) swap(core zapcore.Core) zapcore.Core {
+	return c.cur.Swap(coreHolder{core: core}).(coreHolder).core
+}
+
+func (c *swapCore) current() zapcore.Core {
+	return c.cur.Load().(coreHolder).core
+}
+
+func (c *swapCore) Enabled(level zapcore.Level) bool {
+	return c.current().Enabled(level)
+}
+
+func (c *swapCore) With(fields []zapcore.Field) zapcore.Core {
+	all := make([]zapcore.Field, 0, len(c.fields)+len(fields))
+	all = append(append(all, c.fields...), fields...)
+	return &swapCore{cur: c.cur, fields: all}
+}
+
+func (c *swapCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	core := c.current()
+	if !core.Enabled(ent.Level) {
+		return ce
+	}
+	if len(c.fields) > 0 {
+		core = core.With(c.fields)
+	}
+	return core.Check(ent, ce)
+}
+
+func (c *swapCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	core := c.current()
+	if len(c.fields) > 0 {
+		core = core.With(c.fields)
+	}
+	return core.Write(ent, fields)
+}
+
+func (c *swapCore) Sync() error {
+	return c.current().Sync()
+}
+
+// fileSink 日志文件, 关闭时等待正在进行的写入, 关闭后不再写入, 避免lumberjack重新打开旧文件
+type fileSink struct {
+	mu     sync.RWMutex
+	w      *lumberjack.Logger
+	closed bool
+}
+
+func (s *fileSink) Write(p []byte) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, errLogClosed
+	}
+	return s.w.Write(p)
+}
+
+func (s *fileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.w.Close()
+}
@@ -123,6 +123,8 @@ func writer(r *http.Request, logger *zap.Logger, level, msg string, title string
 
 func writers(logger *zap.Logger, level, msg string, fields ...zap.Field) {
 	switch level {
+	case LevelDebug:
+		logger.Debug(msg, fields...)
 	case LevelInfo:
 		logger.Info(msg, fields...)
 	case LevelWarn:
@@ -134,6 +136,8 @@ func writers(logger *zap.Logger, level, msg string, fields ...zap.Field) {
 
 func do(logger *zap.Logger, level, msg string, fields ...zap.Field) {
 	switch level {
+	case LevelDebug:
+		logger.Debug(msg, fields...)
 	case LevelInfo:
 		logger.Info(msg, fields...)
 	case LevelWarn:
@@ -165,16 +169,19 @@ func timeEncoder(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
 // RotationTime 设置文件分割时间
 // RotationCount 设置保留的最大文件数量
 func GetWriteSyncer(file string, lc *Config) zapcore.WriteSyncer {
-	lumberJackLogger := &lumberjack.Logger{
+	return zapcore.NewMultiWriteSyncer(zapcore.AddSync(os.Stdout), zapcore.AddSync(newFileWriter(file, lc)))
+
+	//return zapcore.AddSync(lumberJackLogger)
+}
+
+func newFileWriter(file string, lc *Config) *lumberjack.Logger {
+	return &lumberjack.Logger{
 		Filename:   file,                  // 日志文件的位置
 		MaxSize:    int(lc.RotationSize),  // 在进行切割之前，日志文件的最大大小（以MB为单位）
 		MaxBackups: int(lc.RotationCount), // 保留旧文件的最大个数
 		MaxAge:     int(lc.MaxAge),        // 保留旧文件的最大天数
 		Compress:   false,                 // 是否压缩/归档旧文件
 	}
-	return zapcore.NewMultiWriteSyncer(zapcore.AddSync(os.Stdout), zapcore.AddSync(lumberJackLogger))
-
-	//return zapcore.AddSync(lumberJackLogger)
 }
 
 // GetWriter 按天切割按大小切割
@@ -44,7 +44,7 @@ func (l *gormLogger) LogMode(level logger.LogLevel) logger.Interface {
 func (l *gormLogger) Info(ctx context.Context, msg string, data ...interface{}) {
 	begin, end := time.Now(), time.Now()
 	if l.LogLevel >= logger.Info {
-		errInfo := fmt.Sprintf(msg, data)
+		errInfo := fmt.Sprintf(msg, data...)
 		gormWriter(ctx, LevelWarn, 0, "", "", utils.FileWithLineNum(), normalSql, errInfo, begin, end)
 	}
 }
@@ -53,7 +53,7 @@ func (l *gormLogger) Info(ctx context.Context, msg string, data ...interface{})
 func (l *gormLogger) Warn(ctx context.Context, msg string, data ...interface{}) {
 	begin, end := time.Now(), time.Now()
 	if l.LogLevel >= logger.Warn {
-		errInfo := fmt.Sprintf(msg, data)
+		errInfo := fmt.Sprintf(msg, data...)
 		gormWriter(ctx, LevelWarn, 0, "", "", utils.FileWithLineNum(), warnSql, errInfo, begin, end)
 	}
 }
@@ -62,7 +62,7 @@ func (l *gormLogger) Warn(ctx context.Context, msg string, data ...interface{})
 func (l *gormLogger) Error(ctx context.Context, msg string, data ...interface{}) {
 	begin, end := time.Now(), time.Now()
 	if l.LogLevel >= logger.Error {
-		errInfo := fmt.Sprintf(msg, data)
+		errInfo := fmt.Sprintf(msg, data...)
 		gormWriter(ctx, LevelError, 0, "", "", utils.FileWithLineNum(), errSql, errInfo, begin, end)
 	}
 }
@@ -96,11 +96,7 @@ func (l *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (stri
 }
 
 func gormWriter(ctx context.Context, level string, rows int64, sql, slowLog, line, tag, errMsg string, begin, end time.Time) {
-	var requestId string
-	ginCtx, ok := ctx.(*gin.Context)
-	if ok {
-		requestId = ginCtx.GetString(RequestIdKey)
-	}
+	requestId := RequestIdFromContext(ctx)
 	if requestId == "" {
 		requestId = "null"
 	}
@@ -108,11 +104,13 @@ func gormWriter(ctx context.Context, level string, rows int64, sql, slowLog, lin
 	if !ok {
 		database = "null"
 	}
+	// gorm的错误和警告信息中经常带有SQL和参数, 与SQL使用相同的脱敏规则
+	errMsg = MaskSql(errMsg)
 	msg := "db_log"
 	request := gormRequestLog{
 		Database: database,
 		Rows:     rows,
-		Sql:      sql,
+		Sql:      MaskSql(sql),
 		Tag:      tag,
 		SlowLog:  slowLog,
 		Line:     line,
@@ -177,3 +175,15 @@ type gormRequestLog struct {
 //func SetDbLog(v bool) {
 //	dl = v
 //}
+
+// RequestIdFromContext 获取ctx中的链路ID, 支持 gin.Context 以及 appx.Context 等可以通过 Value 读取的context
+func RequestIdFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	if ginCtx, ok := ctx.(*gin.Context); ok {
+		return ginCtx.GetString(RequestIdKey)
+	}
+	requestId, _ := ctx.Value(RequestIdKey).(string)
+	return requestId
+}
@@ -0,0 +1,305 @@
+package logx
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+const defaultMaskReplace = "****"
+
+// MaskRule SQL脱敏规则, Columns 和 Pattern 可以同时设置
+type MaskRule struct {
+	Columns []string `json:"columns"` // 列名, 不区分大小写, 隐藏条件、SET 和 INSERT 中这些列的值, 如 phone、id_card
+	Pattern string   `json:"pattern"` // 正则, 隐藏SQL中匹配的内容, 如手机号 1[3-9]\d{9}
+	Replace string   `json:"replace"` // 替换内容, 默认 ****
+}
+
+// sqlMasker 编译后的脱敏规则
+type sqlMasker struct {
+	columns  map[string]string // 小写列名 => 替换内容
+	patterns []maskPattern
+}
+
+type maskPattern struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+var currentMasker atomic.Value // *sqlMasker
+
+// SetSqlMask 设置gorm日志和审计日志的脱敏规则, 替换之前的规则, 不传时关闭脱敏
+func SetSqlMask(rules ...MaskRule) error {
+	m := &sqlMasker{columns: map[string]string{}}
+	for _, rule := range rules {
+		replace := rule.Replace
+		if replace == "" {
+			replace = defaultMaskReplace
+		}
+		for _, col := range rule.Columns {
+			if col = strings.ToLower(strings.TrimSpace(col)); col != "" {
+				m.columns[col] = replace
+			}
+		}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("sql mask pattern %s invalid: %w", rule.Pattern, err)
+			}
+			m.patterns = append(m.patterns, maskPattern{re: re, replace: replace})
+		}
+	}
+	currentMasker.Store(m)
+	return nil
+}
+
+func getMasker() *sqlMasker {
+	m, _ := currentMasker.Load().(*sqlMasker)
+	if m == nil || (len(m.columns) == 0 && len(m.patterns) == 0) {
+		return nil
+	}
+	return m
+}
+
+// MaskSql 按脱敏规则隐藏SQL中的敏感值
+func MaskSql(sql string) string {
+	m := getMasker()
+	if m == nil || sql == "" {
+		return sql
+	}
+	if len(m.columns) > 0 {
+		sql = m.maskColumns(sql)
+	}
+	for _, p := range m.patterns {
+		sql = p.re.ReplaceAllString(sql, p.replace)
+	}
+	return sql
+}
+
+// MaskValue 列需要脱敏时返回替换内容, 否则按正则规则处理字符串值
+func MaskValue(column string, value interface{}) interface{} {
+	m := getMasker()
+	if m == nil || value == nil {
+		return value
+	}
+	if replace, ok := m.columns[strings.ToLower(column)]; ok {
+		return replace
+	}
+	if s, ok := value.(string); ok {
+		for _, p := range m.patterns {
+			s = p.re.ReplaceAllString(s, p.replace)
+		}
+		return s
+	}
+	return value
+}
+
+// sqlToken SQL词法单元
+type sqlToken struct {
+	kind byte // i标识符 s字符串 n数字 p符号 w空白
+	text string
+}
+
+func (t sqlToken) ident() string {
+	if t.kind != 'i' {
+		return ""
+	}
+	return strings.ToLower(strings.Trim(t.text, "`"))
+}
+
+func (t sqlToken) literal() bool {
+	return t.kind == 's' || t.kind == 'n'
+}
+
+// maskColumns 隐藏 列 操作符 值、列 IN (值...) 以及 INSERT 列表对应位置的值
+func (m *sqlMasker) maskColumns(sql string) string {
+	tokens := tokenizeSql(sql)
+	// 非空白token的下标, 便于向后查看
+	idx := make([]int, 0, len(tokens))
+	for i, t := range tokens {
+		if t.kind != 'w' {
+			idx = append(idx, i)
+		}
+	}
+	replaced := make(map[int]string)
+	mask := func(i int, replace string) {
+		if i < len(tokens) && tokens[i].literal() {
+			replaced[i] = "'" + replace + "'"
+		}
+	}
+	at := func(k int) sqlToken {
+		if k < len(idx) {
+			return tokens[idx[k]]
+		}
+		return sqlToken{}
+	}
+
+	for k := 0; k < len(idx); k++ {
+		t := at(k)
+		if t.ident() == "insert" || t.ident() == "replace" {
+			k = m.maskInsert(k, idx, at, mask)
+			continue
+		}
+		replace, ok := m.columns[t.ident()]
+		if !ok {
+			continue
+		}
+
+		j := k + 1
+		op := strings.ToLower(at(j).text)
+		if op == "not" {
+			j++
+			op = strings.ToLower(at(j).text)
+		}
+		switch op {
+		case "=", "<>", "!=", "<", ">", "<=", ">=", "<=>", "like":
+			if j+1 < len(idx) {
+				mask(idx[j+1], replace)
+			}
+		case "in":
+			if at(j+1).text != "(" {
+				continue
+			}
+			for j += 2; j < len(idx) && at(j).text != ")"; j++ {
+				mask(idx[j], replace)
+			}
+		}
+	}
+	if len(replaced) == 0 {
+		return sql
+	}
+
+	var b strings.Builder
+	b.Grow(len(sql))
+	for i, t := range tokens {
+		if r, ok := replaced[i]; ok {
+			b.WriteString(r)
+		} else {
+			b.WriteString(t.text)
+		}
+	}
+	return b.String()
+}
+
+// maskInsert 处理 INSERT INTO t (a,b) VALUES (..),(..), 返回处理到的位置
+func (m *sqlMasker) maskInsert(k int, idx []int, at func(int) sqlToken, mask func(int, string)) int {
+	// 找到列列表
+	for k < len(idx) && at(k).text != "(" {
+		if at(k).ident() == "values" || at(k).ident() == "set" || at(k).ident() == "select" {
+			return k
+		}
+		k++
+	}
+	var masked []string
+	for k++; k < len(idx) && at(k).text != ")"; k++ {
+		if t := at(k); t.kind == 'i' {
+			masked = append(masked, "")
+			if replace, ok := m.columns[t.ident()]; ok {
+				masked[len(masked)-1] = replace
+			}
+		}
+	}
+	k++
+	if v := at(k).ident(); v != "values" && v != "value" {
+		return k - 1
+	}
+
+	// 逐个处理值列表, 嵌套括号内的值属于同一列
+	for k++; k < len(idx) && at(k).text == "("; k++ {
+		col, depth := 0, 0
+		for ; k < len(idx); k++ {
+			switch at(k).text {
+			case "(":
+				depth++
+				continue
+			case ")":
+				depth--
+			case ",":
+				if depth == 1 {
+					col++
+				}
+				continue
+			}
+			if depth == 0 {
+				break
+			}
+			if col < len(masked) && masked[col] != "" {
+				mask(idx[k], masked[col])
+			}
+		}
+		if at(k+1).text != "," {
+			return k
+		}
+		k++
+	}
+	return k - 1
+}
+
+// tokenizeSql 把SQL拆成标识符、字符串、数字、符号和空白, 拼接后和原SQL一致
+func tokenizeSql(sql string) []sqlToken {
+	var tokens []sqlToken
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			for i < len(sql) && (sql[i] == ' ' || sql[i] == '\t' || sql[i] == '\n' || sql[i] == '\r') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{'w', sql[start:i]})
+		case c == '\'' || c == '"':
+			i++
+			for i < len(sql) {
+				if sql[i] == '\\' {
+					i += 2
+					continue
+				}
+				if sql[i] == c {
+					// 连续两个引号是转义
+					if i+1 < len(sql) && sql[i+1] == c {
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				i++
+			}
+			if i > len(sql) {
+				i = len(sql)
+			}
+			tokens = append(tokens, sqlToken{'s', sql[start:i]})
+		case c == '`':
+			i++
+			for i < len(sql) && sql[i] != '`' {
+				i++
+			}
+			if i < len(sql) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{'i', sql[start:i]})
+		case c >= '0' && c <= '9' || c == '-' && i+1 < len(sql) && sql[i+1] >= '0' && sql[i+1] <= '9':
+			i++
+			for i < len(sql) && (sql[i] >= '0' && sql[i] <= '9' || sql[i] == '.' || sql[i] == 'e' || sql[i] == 'E') {
+				i++
+			}
+			tokens = append(tokens, sqlToken{'n', sql[start:i]})
+		case c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+			for i < len(sql) && (sql[i] == '_' || sql[i] == '$' || sql[i] >= 'a' && sql[i] <= 'z' ||
+				sql[i] >= 'A' && sql[i] <= 'Z' || sql[i] >= '0' && sql[i] <= '9' || sql[i] >= 0x80) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{'i', sql[start:i]})
+		case strings.ContainsRune("<>!=", rune(c)):
+			for i < len(sql) && strings.ContainsRune("<>!=", rune(sql[i])) {
+				i++
+			}
+			tokens = append(tokens, sqlToken{'p', sql[start:i]})
+		default:
+			i++
+			tokens = append(tokens, sqlToken{'p', sql[start:i]})
+		}
+	}
+	return tokens
+}
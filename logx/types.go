@@ -2,6 +2,7 @@ package logx
 
 import (
 	"go.uber.org/zap"
+	"sync"
 	"time"
 )
 
@@ -17,6 +18,7 @@ const (
 	//DefaultNoBuffWrite   = false               // 不不开启无缓冲写入
 	//DefaultMaxAge        = 90 * 24 * time.Hour // 默认保留90天
 
+	LevelDebug   = "debug"
 	LevelInfo    = "info"
 	LevelWarn    = "warn"
 	LevelError   = "error"
@@ -39,11 +41,13 @@ var (
 	DefaultLogType               = "file"              // 默认日志类型
 	DefaultLogPath               = "/home/logs/app/"   // 默认文件目录
 	DefaultChildPath             = "/file-%s.log"      // 默认子目录
+	DefaultAuditPath             = "/audit-%s.log"     // 默认审计日志子目录
 	DefaultRotationSize          = 32 * 1024 * 1024    // 默认大小为32M
 	DefaultRotationCount         = 0                   // 默认不限制
 	DefaultRotationTime          = 24 * time.Hour      // 默认每天轮转一次
 	DefaultNoBuffWrite           = false               // 不不开启无缓冲写入
 	DefaultMaxAge                = 90 * 24 * time.Hour // 默认保留90天
+	DefaultLogLevel              = "info"              // 默认日志级别
 	DefaultTraceType             = "zipkin"            //记录类型 zipkin 和 jaeger
 	DefaultTraceAddr             = ""
 	DefaultTraceMod      float64 = 0
@@ -62,6 +66,8 @@ type Config struct {
 	NoBuffWrite   bool          `json:"no_buff_write"`  // 设置无缓冲日志写入
 	RotationTime  time.Duration `json:"rotation_time"`  // 日志分割的时间
 	MaxAge        time.Duration `json:"max_age"`        // 日志最大保留的天数
+	LogLevel      string        `json:"log_level"`      // 日志级别 debug/info/warn/error
+	AuditPath     string        `json:"audit_path"`     // 审计日志子路径+文件名
 }
 
 type LogOptionFunc func(*Config)
@@ -71,6 +77,14 @@ type Field = zap.Field
 var (
 	Sugar *zap.Logger
 
+	logLock    sync.Mutex
+	logCore    *swapCore // Sugar 的core, 重建日志时替换
+	fileWriter *fileSink // 当前写入的日志文件, 重建日志时关闭
+
+	AuditSugar  *zap.Logger // 审计日志, 单独写入 AuditPath
+	auditCore   *swapCore   // AuditSugar 的core
+	auditWriter *fileSink   // 当前写入的审计日志文件, 重建日志时关闭
+
 	defaultLogLevel = zap.NewAtomicLevel()
 	DefaultConfig   = &Config{
 		AppName:       DefaultAppName,
@@ -83,5 +97,7 @@ var (
 		NoBuffWrite:   DefaultNoBuffWrite,
 		RotationTime:  DefaultRotationTime,
 		MaxAge:        DefaultMaxAge,
+		LogLevel:      DefaultLogLevel,
+		AuditPath:     DefaultAuditPath,
 	}
 )
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/laydong/toolpkg/db"
 	"github.com/laydong/toolpkg/logx"
 	"go.uber.org/zap"
 	"io/ioutil"
@@ -12,7 +13,7 @@ import (
 	"time"
 )
 
-// MiddlewareApiLog 记录框架出入参, 开启链路追踪
+// MiddlewareApiLog 记录框架出入参和请求内的查询次数、耗时, 开启链路追踪
 func MiddlewareApiLog(c *gin.Context) {
 	start := time.Now()
 	traceId := c.GetHeader(logx.XtraceKey)
@@ -38,6 +39,7 @@ func MiddlewareApiLog(c *gin.Context) {
 	c.Writer = blw
 	c.Next()
 	request.Body = string(body)
+	queries, dbTime := db.GetQueryStats(c).Totals()
 	// 自行处理日志
 	logx.InfoApi(c, "API请求日志",
 		zap.Any("request", request),
@@ -47,6 +49,8 @@ func MiddlewareApiLog(c *gin.Context) {
 		zap.Any("run_time_long", time.Since(start)*time.Millisecond), //运行时长毫秒
 		zap.Any("error", strings.TrimRight(c.Errors.ByType(gin.ErrorTypePrivate).String(), "\n")),
 		zap.Any("source", c.GetHeader("app_name")),
+		zap.Int("db_queries", queries),
+		zap.String("db_time", fmt.Sprintf("%.3fms", float64(dbTime.Nanoseconds())/1e6)),
 	)
 }
 
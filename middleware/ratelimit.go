@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/laydong/toolpkg/limitx"
+	"github.com/laydong/toolpkg/logx"
+	"github.com/laydong/toolpkg/utils"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// RateLimitKeyFunc 限流的key, 返回空时不限流
+type RateLimitKeyFunc func(c *gin.Context) string
+
+// RateLimitByIP 按客户端IP限流
+func RateLimitByIP() RateLimitKeyFunc {
+	return func(c *gin.Context) string {
+		return "ip:" + utils.RemoteIp(c.Request)
+	}
+}
+
+// RateLimitByHeader 按header限流, 如 X-App-Key, header为空时不限流
+func RateLimitByHeader(name string) RateLimitKeyFunc {
+	return func(c *gin.Context) string {
+		v := c.GetHeader(name)
+		if v == "" {
+			return ""
+		}
+		return "header:" + name + ":" + v
+	}
+}
+
+// RateLimitByRoute 按路由限流, 所有客户端共享一个路由的额度, 未匹配的路由不限流
+func RateLimitByRoute() RateLimitKeyFunc {
+	return func(c *gin.Context) string {
+		path := c.FullPath()
+		if path == "" {
+			return ""
+		}
+		return "route:" + c.Request.Method + ":" + path
+	}
+}
+
+// RateLimit 限流中间件, 超出额度时返回429和标准的 utils.Response
+// redis出错时放行并记录错误日志, 避免redis故障导致服务不可用
+func RateLimit(l *limitx.Limiter, key RateLimitKeyFunc) gin.HandlerFunc {
+	limit := strconv.Itoa(l.Rule().Limit)
+	return func(c *gin.Context) {
+		k := key(c)
+		if k == "" {
+			c.Next()
+			return
+		}
+		res, err := l.Allow(c, k)
+		if err != nil {
+			logx.ErrorF(c, "rate limit failed, key: %s, err: %s", k, err.Error())
+			c.Next()
+			return
+		}
+		c.Header("X-RateLimit-Limit", limit)
+		c.Header("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		if res.Allowed {
+			c.Next()
+			return
+		}
+		if res.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+		}
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, utils.Response{
+			Code:      http.StatusTooManyRequests,
+			Data:      map[string]interface{}{},
+			Msg:       "请求过于频繁, 请稍后再试",
+			RequestID: c.GetString(utils.RequestIdKey),
+		})
+	}
+}
@@ -0,0 +1,475 @@
+package queuex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/laydong/toolpkg/appx"
+	"github.com/laydong/toolpkg/datax"
+	"github.com/laydong/toolpkg/logx"
+	"github.com/laydong/toolpkg/utils"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWorkers       = 10
+	defaultBlock         = 2 * time.Second
+	defaultMaxRetries    = 3
+	defaultRetryBackoff  = time.Second
+	defaultMaxBackoff    = 10 * time.Minute
+	defaultClaimIdle     = 5 * time.Minute
+	defaultClaimInterval = time.Minute
+	defaultDelayPoll     = time.Second
+	errorBackoff         = time.Second // redis出错后等待的时间
+
+	messageIdKey = "queue_message_id" // appx.Context 中的消息id
+)
+
+// Handler 处理消息, 返回error时按退避时间重试, 超过重试次数写入死信
+type Handler func(ctx *appx.Context, msg *Message) error
+
+// ConsumerOptions 消费者选项
+type ConsumerOptions struct {
+	Name          string        // 消费者名称, 同一个消费组内唯一, 默认 主机名-进程id
+	Workers       int           // 同时处理的消息数, 默认10
+	Block         time.Duration // 没有消息时阻塞等待的时间, 默认2秒, 也是 Stop 最长的等待时间
+	MaxRetries    int           // 最大重试次数, 默认3, 小于0不重试, 被接管的未确认投递也计为一次失败
+	RetryBackoff  time.Duration // 第一次重试的等待时间, 之后每次翻倍, 默认1秒
+	MaxBackoff    time.Duration // 重试的最大等待时间, 默认10分钟
+	Timeout       time.Duration // 单条消息的处理超时, 默认不限制
+	ClaimIdle     time.Duration // 超过这个时间未确认的消息被认为卡住, 由其他消费者接管, 默认5分钟, 需要大于处理耗时
+	ClaimInterval time.Duration // 检查卡住消息的间隔, 默认1分钟
+	DelayPoll     time.Duration // 检查到期延迟消息的间隔, 默认1秒
+}
+
+type ConsumerOptionFunc func(*ConsumerOptions)
+
+// WithConsumerName 设置消费者名称
+func WithConsumerName(name string) ConsumerOptionFunc {
+	return func(o *ConsumerOptions) {
+		o.Name = name
+	}
+}
+
+// WithWorkers 设置同时处理的消息数
+func WithWorkers(n int) ConsumerOptionFunc {
+	return func(o *ConsumerOptions) {
+		if n > 0 {
+			o.Workers = n
+		}
+	}
+}
+
+// WithRetry 设置重试次数和退避时间
+func WithRetry(maxRetries int, backoff, maxBackoff time.Duration) ConsumerOptionFunc {
+	return func(o *ConsumerOptions) {
+		o.MaxRetries = maxRetries
+		if backoff > 0 {
+			o.RetryBackoff = backoff
+		}
+		if maxBackoff > 0 {
+			o.MaxBackoff = maxBackoff
+		}
+	}
+}
+
+// WithTimeout 设置单条消息的处理超时
+func WithTimeout(timeout time.Duration) ConsumerOptionFunc {
+	return func(o *ConsumerOptions) {
+		o.Timeout = timeout
+	}
+}
+
+// WithClaim 设置卡住消息的判断时间和检查间隔
+func WithClaim(idle, interval time.Duration) ConsumerOptionFunc {
+	return func(o *ConsumerOptions) {
+		if idle > 0 {
+			o.ClaimIdle = idle
+		}
+		if interval > 0 {
+			o.ClaimInterval = interval
+		}
+	}
+}
+
+// WithBlock 设置没有消息时阻塞等待的时间
+func WithBlock(block time.Duration) ConsumerOptionFunc {
+	return func(o *ConsumerOptions) {
+		if block > 0 {
+			o.Block = block
+		}
+	}
+}
+
+// WithDelayPoll 设置检查到期延迟消息的间隔, 决定延迟消息和重试的精度
+func WithDelayPoll(interval time.Duration) ConsumerOptionFunc {
+	return func(o *ConsumerOptions) {
+		if interval > 0 {
+			o.DelayPoll = interval
+		}
+	}
+}
+
+// Consumer 消费组中的一个消费者, 消息在固定数量的worker中处理
+// 每条消息使用新的 appx.Context, 带有发送方的request_id和baggage
+type Consumer struct {
+	q       *Queue
+	group   string
+	handler Handler
+	opts    ConsumerOptions
+
+	jobs   chan *Message
+	cancel context.CancelFunc
+	wg     sync.WaitGroup // 读取和接管
+	workWg sync.WaitGroup // worker
+	done   chan struct{}
+}
+
+// NewConsumer 创建消费者, 不同的消费组都会收到全部消息, 同一个消费组内的消费者分摊消息
+func (q *Queue) NewConsumer(group string, handler Handler, opts ...ConsumerOptionFunc) *Consumer {
+	host, _ := os.Hostname()
+	o := ConsumerOptions{
+		Name:          fmt.Sprintf("%s-%d", host, os.Getpid()),
+		Workers:       defaultWorkers,
+		Block:         defaultBlock,
+		MaxRetries:    defaultMaxRetries,
+		RetryBackoff:  defaultRetryBackoff,
+		MaxBackoff:    defaultMaxBackoff,
+		ClaimIdle:     defaultClaimIdle,
+		ClaimInterval: defaultClaimInterval,
+		DelayPoll:     defaultDelayPoll,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+	return &Consumer{q: q, group: group, handler: handler, opts: o}
+}
+
+// Start 创建消费组并开始消费, 不阻塞, 消费组从stream中最早的消息开始消费
+func (c *Consumer) Start() error {
+	if c.handler == nil {
+		return errors.New("queuex: handler is nil")
+	}
+	if err := c.createGroup(context.Background()); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.jobs = make(chan *Message)
+	c.done = make(chan struct{})
+
+	for i := 0; i < c.opts.Workers; i++ {
+		c.workWg.Add(1)
+		go c.work()
+	}
+	// 拉取和轮询的命令成功时只写debug日志
+	poll := utils.WithQuietLog(ctx)
+	c.wg.Add(3)
+	go c.read(poll)
+	go c.claim(poll)
+	go c.moveDue(poll)
+	go func() {
+		c.wg.Wait()
+		close(c.jobs)
+		c.workWg.Wait()
+		close(c.done)
+	}()
+	return nil
+}
+
+// Stop 停止消费, 返回的context在正在处理的消息都结束后关闭
+// 已经读取但未处理的消息留在待确认列表中, 由其他消费者或下次启动后接管
+func (c *Consumer) Stop() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	if c.cancel == nil {
+		cancel()
+		return ctx
+	}
+	c.cancel()
+	go func() {
+		<-c.done
+		cancel()
+	}()
+	return ctx
+}
+
+func (c *Consumer) createGroup(ctx context.Context) error {
+	err := c.q.rdb.XGroupCreateMkStream(ctx, c.q.streamKey(), c.group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("queuex: create group %s failed: %w", c.group, err)
+	}
+	return nil
+}
+
+// read 读取新消息, worker都在忙时阻塞
+func (c *Consumer) read(ctx context.Context) {
+	defer c.wg.Done()
+	for ctx.Err() == nil {
+		streams, err := c.q.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    c.group,
+			Consumer: c.opts.Name,
+			Streams:  []string{c.q.streamKey(), ">"},
+			Count:    int64(c.opts.Workers),
+			Block:    c.opts.Block,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// stream被删除后重新创建消费组
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				_ = c.createGroup(ctx)
+			}
+			logx.Error("queuex %s read failed, err: %s", c.q.name, err.Error())
+			sleep(ctx, errorBackoff)
+			continue
+		}
+		for _, stream := range streams {
+			msgs := make([]*Message, 0, len(stream.Messages))
+			for _, xm := range stream.Messages {
+				msgs = append(msgs, parseMessage(xm))
+			}
+			c.dispatch(ctx, msgs)
+		}
+	}
+}
+
+// claim 定时接管其他消费者长时间未确认的消息
+// 接管说明之前的处理卡住或进程崩溃, 每次未确认的投递计为一次失败, 超过重试次数的消息不再处理, 直接写入死信
+func (c *Consumer) claim(ctx context.Context) {
+	defer c.wg.Done()
+	for sleep(ctx, c.opts.ClaimInterval) {
+		start := "0-0"
+		for ctx.Err() == nil {
+			next, xms, deleted, err := c.autoClaim(ctx, start)
+			if err != nil {
+				if ctx.Err() == nil {
+					logx.Error("queuex %s claim failed, err: %s", c.q.name, err.Error())
+				}
+				break
+			}
+			if len(deleted) > 0 {
+				if err := c.q.rdb.XAck(ctx, c.q.streamKey(), c.group, deleted...).Err(); err != nil {
+					logx.Error("queuex %s ack deleted messages failed, err: %s", c.q.name, err.Error())
+				}
+			}
+			c.dispatch(ctx, c.claimed(ctx, xms))
+			if next == "0-0" || next == "" {
+				break
+			}
+			start = next
+		}
+	}
+}
+
+// autoClaim 执行 XAUTOCLAIM, go-redis v8 的 XAutoClaim 无法解析redis 7返回的三个元素, 这里自己解析
+// 返回下次开始的id、接管的消息和已经从stream删除的消息id
+func (c *Consumer) autoClaim(ctx context.Context, start string) (string, []redis.XMessage, []string, error) {
+	res, err := c.q.rdb.Do(ctx, "xautoclaim", c.q.streamKey(), c.group, c.opts.Name,
+		c.opts.ClaimIdle.Milliseconds(), start, "count", c.opts.Workers).Slice()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if len(res) < 2 {
+		return "", nil, nil, fmt.Errorf("queuex: unexpected xautoclaim reply %v", res)
+	}
+	next, _ := res[0].(string)
+	items, _ := res[1].([]interface{})
+	msgs := make([]redis.XMessage, 0, len(items))
+	var deleted []string
+	// redis 7 在第三个元素返回已删除的id
+	if len(res) > 2 {
+		ids, _ := res[2].([]interface{})
+		for _, id := range ids {
+			if s, ok := id.(string); ok {
+				deleted = append(deleted, s)
+			}
+		}
+	}
+	for _, item := range items {
+		entry, ok := item.([]interface{})
+		if !ok || len(entry) != 2 {
+			continue
+		}
+		id, _ := entry[0].(string)
+		// redis 6.2 中已经被删除的消息没有字段, 需要确认后才会离开待确认列表
+		kv, ok := entry[1].([]interface{})
+		if !ok {
+			deleted = append(deleted, id)
+			continue
+		}
+		values := make(map[string]interface{}, len(kv)/2)
+		for i := 0; i+1 < len(kv); i += 2 {
+			k, _ := kv[i].(string)
+			values[k] = kv[i+1]
+		}
+		msgs = append(msgs, redis.XMessage{ID: id, Values: values})
+	}
+	return next, msgs, deleted, nil
+}
+
+// claimed 解析接管的消息, 按待确认列表中的投递次数增加失败次数, 查询失败时按一次计算
+func (c *Consumer) claimed(ctx context.Context, xms []redis.XMessage) []*Message {
+	if len(xms) == 0 {
+		return nil
+	}
+	pipe := c.q.rdb.Pipeline()
+	cmds := make([]*redis.XPendingExtCmd, 0, len(xms))
+	for _, xm := range xms {
+		cmds = append(cmds, pipe.XPendingExt(ctx, &redis.XPendingExtArgs{
+			Stream: c.q.streamKey(),
+			Group:  c.group,
+			Start:  xm.ID,
+			End:    xm.ID,
+			Count:  1,
+		}))
+	}
+	_, _ = pipe.Exec(ctx)
+
+	msgs := make([]*Message, 0, len(xms))
+	for i, xm := range xms {
+		msg := parseMessage(xm)
+		// 第一次投递不算失败, 接管时 XAUTOCLAIM 已经增加了投递次数
+		failed := 1
+		if pending, err := cmds[i].Result(); err == nil && len(pending) == 1 && pending[0].RetryCount > 1 {
+			failed = int(pending[0].RetryCount - 1)
+		}
+		msg.Attempt += failed
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// moveDue 定时把到期的延迟消息和重试消息写入stream
+func (c *Consumer) moveDue(ctx context.Context) {
+	defer c.wg.Done()
+	for sleep(ctx, c.opts.DelayPoll) {
+		for ctx.Err() == nil {
+			n, err := c.q.moveDue(ctx, 100)
+			if err != nil {
+				if ctx.Err() == nil {
+					logx.Error("queuex %s move delayed failed, err: %s", c.q.name, err.Error())
+				}
+				break
+			}
+			if n < 100 {
+				break
+			}
+		}
+	}
+}
+
+func (c *Consumer) dispatch(ctx context.Context, msgs []*Message) {
+	for _, msg := range msgs {
+		select {
+		case c.jobs <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Consumer) work() {
+	defer c.workWg.Done()
+	for msg := range c.jobs {
+		c.handle(msg)
+	}
+}
+
+// handle 处理一条消息, 成功时确认, 失败时重试或写入死信
+func (c *Consumer) handle(msg *Message) {
+	ctx := context.Background()
+	// 其他消费组的重试消息
+	if msg.group != "" && msg.group != c.group {
+		c.ack(ctx, msg)
+		return
+	}
+
+	maxRetries := c.opts.MaxRetries
+	if maxRetries < 0 {
+		maxRetries = 0
+	}
+	// 接管的消息多次投递都未确认, 可能每次处理都导致进程崩溃, 不再处理
+	if msg.Attempt > maxRetries {
+		err := fmt.Errorf("queuex: message %s failed %d times without ack", msg.ID, msg.Attempt)
+		logx.ErrorLogId(msg.RequestId, "queuex %s dead letter message %s, err: %s", c.q.name, msg.ID, err.Error())
+		c.fail(ctx, msg, err, true)
+		return
+	}
+
+	last := msg.Attempt >= maxRetries
+	job := &appx.Job{
+		Name:    "queuex:" + c.q.name,
+		Timeout: c.opts.Timeout,
+		NoAlarm: !last, // 只有最后一次失败时告警
+		BeforeRun: func(ctx *appx.Context) {
+			datax.ExtractBaggage(ctx.MemoryContext, func(header string) string {
+				return msg.Headers[header]
+			})
+			ctx.Set(messageIdKey, msg.ID)
+		},
+		Run: func(ctx *appx.Context) error {
+			return c.handler(ctx, msg)
+		},
+	}
+	result := job.Execute(ctx, msg.RequestId)
+	if result.Err == nil {
+		c.ack(ctx, msg)
+		return
+	}
+	c.fail(ctx, msg, result.Err, last)
+}
+
+// fail 确认失败的消息, dead为true时写入死信, 否则写入延迟重试
+func (c *Consumer) fail(ctx context.Context, msg *Message, err error, dead bool) {
+	pipe := c.q.rdb.TxPipeline()
+	if dead {
+		fields := append(msg.fields(c.group), fieldError, err.Error())
+		pipe.XAdd(ctx, c.q.addArgs(c.q.DeadKey(), fields))
+	} else {
+		retry := *msg
+		retry.Attempt++
+		c.q.schedule(ctx, pipe, &retry, c.group, c.backoff(msg.Attempt))
+	}
+	pipe.XAck(ctx, c.q.streamKey(), c.group, msg.StreamID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logx.ErrorLogId(msg.RequestId, "queuex %s retry message %s failed, err: %s", c.q.name, msg.ID, err.Error())
+	}
+}
+
+func (c *Consumer) ack(ctx context.Context, msg *Message) {
+	if err := c.q.rdb.XAck(ctx, c.q.streamKey(), c.group, msg.StreamID).Err(); err != nil {
+		logx.ErrorLogId(msg.RequestId, "queuex %s ack message %s failed, err: %s", c.q.name, msg.ID, err.Error())
+	}
+}
+
+// backoff 第n次重试的等待时间
+func (c *Consumer) backoff(attempt int) time.Duration {
+	d := c.opts.RetryBackoff
+	for i := 0; i < attempt && d < c.opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.opts.MaxBackoff {
+		d = c.opts.MaxBackoff
+	}
+	return d
+}
+
+// sleep 等待d, ctx结束时返回false
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,254 @@
+package queuex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"github.com/laydong/toolpkg/datax"
+	"github.com/laydong/toolpkg/utils"
+	uuid "github.com/satori/go.uuid"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPrefix = "queuex:"
+	defaultMaxLen = 100000 // stream保留的消息数, 超出时近似裁剪
+
+	fieldId        = "msg_id"
+	fieldPayload   = "payload"
+	fieldRequestId = "request_id"
+	fieldAttempt   = "attempt"
+	fieldGroup     = "group" // 重试的消息只由失败的消费组处理
+	fieldError     = "error"
+	fieldHeader    = "h:" // baggage header的前缀
+)
+
+// moveDueScript 把到期的延迟消息写入stream, KEYS 为 zset、stream 和每个成员的hash, ARGV 为 当前时间、MAXLEN 和成员
+// 脚本只访问 KEYS 中的key, hash与zset使用相同的hash tag, 集群模式下在同一个节点
+// 成员已经被其他消费者移动或还没有到期时跳过
+var moveDueScript = redis.NewScript(`
+local moved = 0
+for i = 3, #ARGV do
+	local item, key = ARGV[i], KEYS[i]
+	local score = redis.call('ZSCORE', KEYS[1], item)
+	if score and tonumber(score) <= tonumber(ARGV[1]) then
+		local fields = redis.call('HGETALL', key)
+		if #fields > 0 then
+			redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[2], '*', unpack(fields))
+			moved = moved + 1
+		end
+		redis.call('DEL', key)
+		redis.call('ZREM', KEYS[1], item)
+	end
+end
+return moved`)
+
+// Options 队列选项
+type Options struct {
+	Prefix string // key前缀, 默认 queuex:
+	MaxLen int64  // stream保留的消息数, 默认10万, 多个消费组时需要大于消费的积压量
+}
+
+type OptionFunc func(*Options)
+
+// WithPrefix 设置key前缀
+func WithPrefix(prefix string) OptionFunc {
+	return func(o *Options) {
+		o.Prefix = prefix
+	}
+}
+
+// WithMaxLen 设置stream保留的消息数
+func WithMaxLen(n int64) OptionFunc {
+	return func(o *Options) {
+		if n > 0 {
+			o.MaxLen = n
+		}
+	}
+}
+
+// Queue 基于redis stream的任务队列, 需要redis 6.2及以上
+// 消息、延迟消息和死信使用相同的hash tag, 集群模式下在同一个节点
+type Queue struct {
+	rdb  redis.UniversalClient
+	name string
+	opts Options
+}
+
+// New 创建队列, rdb 通常为 db.InitRdb 或 appx.App.Redis() 返回的客户端
+func New(rdb redis.UniversalClient, name string, opts ...OptionFunc) *Queue {
+	o := Options{Prefix: defaultPrefix, MaxLen: defaultMaxLen}
+	for _, f := range opts {
+		f(&o)
+	}
+	return &Queue{rdb: rdb, name: name, opts: o}
+}
+
+// Name 队列名称
+func (q *Queue) Name() string {
+	return q.name
+}
+
+func (q *Queue) streamKey() string {
+	return q.opts.Prefix + "{" + q.name + "}"
+}
+
+func (q *Queue) delayedKey() string {
+	return q.streamKey() + ":delayed"
+}
+
+// DeadKey 死信stream的key, 超过重试次数的消息写入这里, 带有 group 和 error 字段
+func (q *Queue) DeadKey() string {
+	return q.streamKey() + ":dead"
+}
+
+// Enqueue 发送消息, payload 为 []byte 或 string 时原样发送, 其他类型编码为JSON
+// ctx中的request_id和baggage随消息一起发送, 消费时写入处理消息的 appx.Context, 返回消息id
+func (q *Queue) Enqueue(ctx context.Context, payload interface{}) (string, error) {
+	return q.EnqueueDelay(ctx, payload, 0)
+}
+
+// EnqueueDelay 发送延迟消息, 到期后才能被消费, 精度取决于消费者的 DelayPoll
+func (q *Queue) EnqueueDelay(ctx context.Context, payload interface{}, delay time.Duration) (string, error) {
+	data, err := encodePayload(payload)
+	if err != nil {
+		return "", err
+	}
+	msg := &Message{ID: uuid.NewV4().String(), Payload: data, Headers: map[string]string{}}
+	if ctx != nil {
+		msg.RequestId, _ = ctx.Value(utils.RequestIdKey).(string)
+		datax.InjectBaggage(ctx, func(header, value string) {
+			msg.Headers[header] = value
+		})
+	}
+	if delay > 0 {
+		_, err = q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			q.schedule(ctx, pipe, msg, "", delay)
+			return nil
+		})
+	} else {
+		err = q.rdb.XAdd(ctx, q.addArgs(q.streamKey(), msg.fields(""))).Err()
+	}
+	if err != nil {
+		return "", err
+	}
+	return msg.ID, nil
+}
+
+func (q *Queue) addArgs(stream string, fields []interface{}) *redis.XAddArgs {
+	return &redis.XAddArgs{Stream: stream, MaxLen: q.opts.MaxLen, Approx: true, Values: fields}
+}
+
+// schedule 写入延迟消息, zset的成员为 消息id:消费组, 字段原样写入成员对应的hash, 二进制的payload不会被编码破坏
+// 同一条消息在不同消费组的重试互不覆盖
+func (q *Queue) schedule(ctx context.Context, pipe redis.Pipeliner, msg *Message, group string, delay time.Duration) {
+	member := msg.ID + ":" + group
+	due := time.Now().Add(delay).UnixMilli()
+	pipe.HSet(ctx, q.memberKey(member), msg.fields(group)...)
+	pipe.ZAdd(ctx, q.delayedKey(), &redis.Z{Score: float64(due), Member: member})
+}
+
+// memberKey 延迟消息字段所在的hash
+func (q *Queue) memberKey(member string) string {
+	return q.delayedKey() + ":" + member
+}
+
+// moveDue 把到期的延迟消息写入stream, 返回移动的数量
+// 先读出到期的成员, 脚本需要的key都通过 KEYS 传入
+func (q *Queue) moveDue(ctx context.Context, limit int) (int, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	items, err := q.rdb.ZRangeByScore(ctx, q.delayedKey(), &redis.ZRangeBy{
+		Min: "-inf", Max: now, Count: int64(limit),
+	}).Result()
+	if err != nil || len(items) == 0 {
+		return 0, err
+	}
+	keys := make([]string, 0, len(items)+2)
+	args := make([]interface{}, 0, len(items)+2)
+	keys = append(keys, q.delayedKey(), q.streamKey())
+	args = append(args, now, q.opts.MaxLen)
+	for _, item := range items {
+		keys = append(keys, q.memberKey(item))
+		args = append(args, item)
+	}
+	return moveDueScript.Run(ctx, q.rdb, keys, args...).Int()
+}
+
+// Message 队列消息
+type Message struct {
+	ID        string            // 消息id, 重试时不变
+	StreamID  string            // stream中的id, 每次重试都不同
+	Payload   []byte            // 消息内容
+	RequestId string            // 发送方的request_id
+	Attempt   int               // 已经失败的次数
+	Headers   map[string]string // 发送方的baggage
+	group     string
+}
+
+// Bind 将JSON格式的消息内容解码到v
+func (m *Message) Bind(v interface{}) error {
+	return json.Unmarshal(m.Payload, v)
+}
+
+// fields stream中的字段, 都使用字符串, 延迟消息在lua中从hash原样写入stream
+func (m *Message) fields(group string) []interface{} {
+	fields := []interface{}{
+		fieldId, m.ID,
+		fieldPayload, string(m.Payload),
+		fieldRequestId, m.RequestId,
+		fieldAttempt, strconv.Itoa(m.Attempt),
+	}
+	if group != "" {
+		fields = append(fields, fieldGroup, group)
+	}
+	for k, v := range m.Headers {
+		fields = append(fields, fieldHeader+k, v)
+	}
+	return fields
+}
+
+func parseMessage(xm redis.XMessage) *Message {
+	msg := &Message{StreamID: xm.ID, Headers: map[string]string{}}
+	for k, v := range xm.Values {
+		s, _ := v.(string)
+		switch {
+		case k == fieldId:
+			msg.ID = s
+		case k == fieldPayload:
+			msg.Payload = []byte(s)
+		case k == fieldRequestId:
+			msg.RequestId = s
+		case k == fieldAttempt:
+			msg.Attempt, _ = strconv.Atoi(s)
+		case k == fieldGroup:
+			msg.group = s
+		case strings.HasPrefix(k, fieldHeader):
+			msg.Headers[strings.TrimPrefix(k, fieldHeader)] = s
+		}
+	}
+	if msg.ID == "" {
+		msg.ID = xm.ID
+	}
+	return msg
+}
+
+func encodePayload(payload interface{}) ([]byte, error) {
+	switch v := payload.(type) {
+	case nil:
+		return nil, errors.New("queuex: payload is nil")
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("queuex: marshal payload failed: %w", err)
+		}
+		return data, nil
+	}
+}
@@ -0,0 +1,76 @@
+package tracex
+
+import (
+	"github.com/openzipkin/zipkin-go"
+	"github.com/uber/jaeger-client-go"
+	"sync"
+)
+
+// sampler 可动态调整采样率的采样器, 同时适配zipkin和jaeger
+type sampler struct {
+	mu     sync.RWMutex
+	zipkin zipkin.Sampler
+	jaeger *jaeger.ProbabilisticSampler
+	rate   float64
+}
+
+var _ jaeger.Sampler = &sampler{}
+
+// globalSampler 当前tracer使用的采样器
+var globalSampler = newSampler(0)
+
+func newSampler(rate float64) *sampler {
+	s := &sampler{}
+	_ = s.setRate(rate)
+	return s
+}
+
+// SetSampleRate 动态调整链路采样率, 取值范围[0, 1], 不需要重建tracer
+func SetSampleRate(rate float64) error {
+	return globalSampler.setRate(rate)
+}
+
+// GetSampleRate 获取当前的链路采样率
+func GetSampleRate() float64 {
+	globalSampler.mu.RLock()
+	defer globalSampler.mu.RUnlock()
+	return globalSampler.rate
+}
+
+func (s *sampler) setRate(rate float64) error {
+	zs, err := zipkin.NewBoundarySampler(rate, 100)
+	if err != nil {
+		return err
+	}
+	js, err := jaeger.NewProbabilisticSampler(rate)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.zipkin, s.jaeger, s.rate = zs, js, rate
+	s.mu.Unlock()
+	return nil
+}
+
+// zipkinSample 实现 zipkin.Sampler
+func (s *sampler) zipkinSample(id uint64) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.zipkin(id)
+}
+
+// IsSampled 实现 jaeger.Sampler
+func (s *sampler) IsSampled(id jaeger.TraceID, operation string) (bool, []jaeger.Tag) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.jaeger.IsSampled(id, operation)
+}
+
+// Close 实现 jaeger.Sampler
+func (s *sampler) Close() {}
+
+// Equal 实现 jaeger.Sampler
+func (s *sampler) Equal(other jaeger.Sampler) bool {
+	return s == other
+}
@@ -1,6 +1,7 @@
 package tracex
 
 import (
+	"context"
 	"github.com/laydong/toolpkg/metautils"
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
@@ -73,3 +74,46 @@ func NewTraceContext(name string, headers map[string][]string) *TraceContext {
 
 	return ctx
 }
+
+// TraceContextKey DataContext 中保存 TraceContext 的key, 用于从任意context中找到链路
+const TraceContextKey = "__tracex_ctx"
+
+// traceContextGetter appx.Context、grpcx.GrpcContext、httpx.WebContext 等嵌入了 TraceContext 的context
+type traceContextGetter interface {
+	GetTraceContext() *TraceContext
+}
+
+// GetTraceContext 获取 TraceContext 本身, 嵌入 TraceContext 的结构体可以通过它取到
+func (ctx *TraceContext) GetTraceContext() *TraceContext {
+	return ctx
+}
+
+// FromContext 从context中获取 TraceContext, 支持嵌入了 TraceContext 的context以及由它们派生的context
+// gin.Context 需要先通过 httpx.NewWebContext 创建链路, 找不到时返回nil
+func FromContext(ctx context.Context) *TraceContext {
+	if ctx == nil {
+		return nil
+	}
+	if g, ok := ctx.(traceContextGetter); ok {
+		if tc := g.GetTraceContext(); tc != nil {
+			return tc
+		}
+	}
+	if tc, ok := ctx.Value(TraceContextKey).(*TraceContext); ok {
+		return tc
+	}
+	return nil
+}
+
+// ChildSpan 以 TopSpan 为父span开启子span, 没有链路时返回nil
+func (ctx *TraceContext) ChildSpan(name string, opts ...opentracing.StartSpanOption) opentracing.Span {
+	if ctx == nil || ctx.TopSpan == nil {
+		return nil
+	}
+	t, err := getTracer()
+	if err != nil || t == nil {
+		return nil
+	}
+	opts = append([]opentracing.StartSpanOption{opentracing.ChildOf(ctx.TopSpan.Context())}, opts...)
+	return t.StartSpan(name, opts...)
+}
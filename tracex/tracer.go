@@ -6,6 +6,7 @@ import (
 	"github.com/laydong/toolpkg/logx"
 	"github.com/laydong/toolpkg/utils"
 	"github.com/opentracing/opentracing-go"
+	"io"
 	"log"
 )
 
@@ -14,28 +15,49 @@ const (
 	TraceTypeZipkin = "zipkin"
 )
 
-// tracer 全局单例变量
-var tracer opentracing.Tracer
+var (
+	// tracer 全局单例变量
+	tracer opentracing.Tracer
+	// tracerCloser 关闭tracer时用于上报剩余的span
+	tracerCloser io.Closer
+)
+
+// InitTrace 按传入的配置初始化trace
+// serviceName 服务名, traceType 记录类型 zipkin 和 jaeger, addr 上报地址, mod 采样率
+func InitTrace(serviceName, traceType, addr string, mod float64) {
+	tracer, tracerCloser = newTracer(serviceName, traceType, addr, mod)
+}
+
+// CloseTrace 关闭trace, 上报缓存中的span
+func CloseTrace() error {
+	if tracerCloser == nil {
+		return nil
+	}
+	err := tracerCloser.Close()
+	tracer, tracerCloser = nil, nil
+	return err
+}
 
-// InitTrace 初始化trace
+// getTracer 获取trace, 未初始化时按logx中的默认配置初始化
 func getTracer() (opentracing.Tracer, error) {
 	if tracer == nil {
-		var err error
-		switch logx.DefaultTraceType {
-		case TraceTypeZipkin:
-			tracer = newZkTracer(logx.DefaultAppName, utils.GetClientIp(), logx.DefaultTraceAddr, logx.DefaultTraceMod)
-			if err != nil {
-				return nil, err
-			}
-			log.Printf("[app] tracer success")
-		case TraceTypeJaeger:
-			tracer = newJTracer(logx.DefaultAppName, logx.DefaultTraceAddr, logx.DefaultTraceMod)
-			if err != nil {
-				return nil, err
-			}
-			log.Printf("[app] tracer success")
-		}
+		tracer, tracerCloser = newTracer(logx.DefaultAppName, logx.DefaultTraceType, logx.DefaultTraceAddr, logx.DefaultTraceMod)
 	}
 
 	return tracer, nil
 }
+
+func newTracer(serviceName, traceType, addr string, mod float64) (t opentracing.Tracer, closer io.Closer) {
+	if err := SetSampleRate(mod); err != nil {
+		log.Printf("[app] tracer sample rate %v invalid, err: %s", mod, err.Error())
+	}
+	switch traceType {
+	case TraceTypeZipkin:
+		t, closer = newZkTracer(serviceName, utils.GetClientIp(), addr, mod)
+		log.Printf("[app] tracer success")
+	case TraceTypeJaeger:
+		t, closer = newJTracer(serviceName, addr, mod)
+		log.Printf("[app] tracer success")
+	}
+	return
+}
@@ -5,9 +5,10 @@ import (
 	"github.com/uber/jaeger-client-go"
 	jaegerCfg "github.com/uber/jaeger-client-go/config"
 	jaegerLog "github.com/uber/jaeger-client-go/log"
+	"io"
 )
 
-func newJTracer(serviceName, addr string, mod float64) opentracing.Tracer {
+func newJTracer(serviceName, addr string, mod float64) (opentracing.Tracer, io.Closer) {
 	var cfg = jaegerCfg.Configuration{
 		ServiceName: serviceName,
 		Sampler: &jaegerCfg.SamplerConfig{
@@ -21,9 +22,10 @@ func newJTracer(serviceName, addr string, mod float64) opentracing.Tracer {
 	}
 
 	jLogger := jaegerLog.StdLogger
-	t, _, _ := cfg.NewTracer(
+	t, closer, _ := cfg.NewTracer(
 		jaegerCfg.Logger(jLogger),
+		jaegerCfg.Sampler(globalSampler),
 	)
 
-	return t
+	return t, closer
 }
@@ -5,10 +5,11 @@ import (
 	zipkinOt "github.com/openzipkin-contrib/zipkin-go-opentracing"
 	"github.com/openzipkin/zipkin-go"
 	zipkinHttp "github.com/openzipkin/zipkin-go/reporter/http"
+	"io"
 	"log"
 )
 
-func newZkTracer(serviceName, serviceEndpoint, addr string, mod float64) opentracing.Tracer {
+func newZkTracer(serviceName, serviceEndpoint, addr string, mod float64) (opentracing.Tracer, io.Closer) {
 
 	// set up a span reporter
 	reporter := zipkinHttp.NewReporter(addr)
@@ -19,14 +20,8 @@ func newZkTracer(serviceName, serviceEndpoint, addr string, mod float64) opentra
 		log.Fatalf("unable to create local endpoint: %+v\n", err)
 	}
 
-	// set up our sampling strategy
-	sampler, err := zipkin.NewBoundarySampler(mod, 100)
-	if err != nil {
-		log.Fatalf("unable to set sampling strategy: %+v\n", err)
-	}
-
 	// initialize our tracer
-	nativeTracer, err := zipkin.NewTracer(reporter, zipkin.WithLocalEndpoint(endpoint), zipkin.WithSampler(sampler))
+	nativeTracer, err := zipkin.NewTracer(reporter, zipkin.WithLocalEndpoint(endpoint), zipkin.WithSampler(globalSampler.zipkinSample))
 	if err != nil {
 		log.Fatalf("unable to create tracer: %+v\n", err)
 	}
@@ -35,5 +30,5 @@ func newZkTracer(serviceName, serviceEndpoint, addr string, mod float64) opentra
 	t := zipkinOt.Wrap(nativeTracer)
 
 	log.Printf("[glogs_trace] zipkin success")
-	return t
+	return t, reporter
 }
@@ -0,0 +1,17 @@
+package utils
+
+import "context"
+
+// quietLogKey 标记后台轮询的ctx
+type quietLogKey struct{}
+
+// WithQuietLog 标记ctx中的命令为后台轮询, 如锁续期和队列拉取, 成功时日志降为debug级别, 失败仍写error日志
+func WithQuietLog(ctx context.Context) context.Context {
+	return context.WithValue(ctx, quietLogKey{}, true)
+}
+
+// IsQuietLog ctx是否标记为后台轮询
+func IsQuietLog(ctx context.Context) bool {
+	quiet, _ := ctx.Value(quietLogKey{}).(bool)
+	return quiet
+}
@@ -3,57 +3,382 @@ package utils
 import (
 	"context"
 	"errors"
-	"fmt"
 	"github.com/go-redis/redis/v8"
 	"github.com/satori/go.uuid"
+	"log"
+	"math/rand"
+	"sync"
 	"time"
 )
 
-// GetLock acquireTimeout Get the lock timeout period, If no lock is obtained within this period, err will be returned here
-// lockTimeOut Lock timeout to prevent deadlock, lock automatically unlocked by this time
-func GetLock(redisConn *redis.Client, lockName string, acquireTimeout, lockTimeOut time.Duration) (string, error) {
-	code := uuid.NewV4().String()
-	// endTime := util.FwTimer.CalcMillis(time.Now().Add(acquireTimeout))
-	endTime := time.Now().Add(acquireTimeout).UnixNano()
-	// for util.FwTimer.CalcMillis(time.Now()) <= endTime {
-	for time.Now().UnixNano() <= endTime {
-		if success, err := redisConn.SetNX(context.Background(), lockName, code, lockTimeOut).Result(); err != nil && err != redis.Nil {
-			return "success", err
-		} else if success {
-			return code, nil
-		} else if redisConn.TTL(context.Background(), lockName).Val() == -1 {
-			redisConn.Expire(context.Background(), lockName, lockTimeOut)
-		}
-		time.Sleep(time.Millisecond)
-	}
-	return "fail", errors.New("timeout")
-}
-
-// ReleaseLock var count = 0  // test assist
-func ReleaseLock(redisConn *redis.Client, lockName, code string) bool {
-	txf := func(tx *redis.Tx) error {
-		if v, err := tx.Get(context.Background(), lockName).Result(); err != nil && err != redis.Nil {
-			return err
-		} else if v == code {
-			_, err := tx.Pipelined(context.Background(), func(pipe redis.Pipeliner) error {
-				// count++
-				// fmt.Println(count)
-				pipe.Del(context.Background(), lockName)
-				return nil
-			})
+const (
+	defaultLockTTL      = 30 * time.Second       // 锁的默认过期时间
+	minLockTTL          = 10 * time.Millisecond  // 锁的最小过期时间, pexpire的精度为毫秒
+	defaultLockRetryMin = 5 * time.Millisecond   // 抢锁失败后的最小等待时间
+	defaultLockRetryMax = 200 * time.Millisecond // 抢锁失败后的最大等待时间
+	lockClockDriftRate  = 0.01                   // redlock 时钟漂移系数
+)
+
+var (
+	ErrLockNotAcquired = errors.New("redis lock: not acquired")
+	ErrLockNotHeld     = errors.New("redis lock: not held")
+)
+
+// 锁使用hash保存, field为持有者, value为重入次数
+// 兼容旧版本 GetLock 使用 SET NX 写入的字符串锁: 视为被占用, 值与持有者相同时可以释放和续期
+var (
+	lockScript = redis.NewScript(`
+local t = redis.call('type', KEYS[1]).ok
+if t == 'none' or (t == 'hash' and redis.call('hexists', KEYS[1], ARGV[1]) == 1) then
+	redis.call('hincrby', KEYS[1], ARGV[1], 1)
+	redis.call('pexpire', KEYS[1], ARGV[2])
+	return 1
+end
+return 0`)
+
+	unlockScript = redis.NewScript(`
+local t = redis.call('type', KEYS[1]).ok
+if t == 'string' then
+	if redis.call('get', KEYS[1]) == ARGV[1] then
+		redis.call('del', KEYS[1])
+		return 0
+	end
+	return -1
+end
+if t ~= 'hash' or redis.call('hexists', KEYS[1], ARGV[1]) == 0 then
+	return -1
+end
+local n = redis.call('hincrby', KEYS[1], ARGV[1], -1)
+if n > 0 then
+	redis.call('pexpire', KEYS[1], ARGV[2])
+	return n
+end
+redis.call('del', KEYS[1])
+return 0`)
+
+	renewScript = redis.NewScript(`
+local t = redis.call('type', KEYS[1]).ok
+if (t == 'hash' and redis.call('hexists', KEYS[1], ARGV[1]) == 1) or (t == 'string' and redis.call('get', KEYS[1]) == ARGV[1]) then
+	return redis.call('pexpire', KEYS[1], ARGV[2])
+end
+return 0`)
+)
+
+// LockOptions 分布式锁选项
+type LockOptions struct {
+	TTL       time.Duration // 锁的过期时间, 默认30秒, 最小10ms, 开启看门狗时每 TTL/3 续期一次
+	Owner     string        // 持有者, 默认每个锁随机生成
+	Reentrant bool          // 可重入, 通过 WithLockOwner 开启, 相同持有者可以重复加锁
+	RetryMin  time.Duration // 抢锁失败后的最小等待时间, 默认5ms, 之后每次翻倍
+	RetryMax  time.Duration // 抢锁失败后的最大等待时间, 默认200ms
+	Watchdog  bool          // 持有期间自动续期, 默认开启
+}
+
+type LockOptionFunc func(*LockOptions)
+
+// WithLockTTL 设置锁的过期时间, 小于10ms时使用10ms
+func WithLockTTL(ttl time.Duration) LockOptionFunc {
+	return func(o *LockOptions) {
+		if ttl > 0 {
+			if ttl < minLockTTL {
+				ttl = minLockTTL
+			}
+			o.TTL = ttl
+		}
+	}
+}
+
+// WithLockOwner 设置持有者并开启重入, 使用相同持有者的锁可以重复加锁, 需要释放相同的次数
+func WithLockOwner(owner string) LockOptionFunc {
+	return func(o *LockOptions) {
+		if owner != "" {
+			o.Owner = owner
+			o.Reentrant = true
+		}
+	}
+}
+
+// WithLockRetry 设置抢锁失败后的退避时间
+func WithLockRetry(min, max time.Duration) LockOptionFunc {
+	return func(o *LockOptions) {
+		if min > 0 {
+			o.RetryMin = min
+		}
+		if max >= o.RetryMin {
+			o.RetryMax = max
+		}
+	}
+}
+
+// WithoutWatchdog 关闭自动续期, 到达过期时间后锁自动释放
+func WithoutWatchdog() LockOptionFunc {
+	return func(o *LockOptions) {
+		o.Watchdog = false
+	}
+}
+
+// RedisLock redis分布式锁, 支持看门狗续期, 多个redis时使用 redlock 算法
+// 默认不可重入, 同一个 RedisLock 在多个goroutine之间也是互斥的
+// 通过 WithLockOwner 开启重入后, 使用相同持有者的goroutine和副本共享锁
+type RedisLock struct {
+	clients []redis.UniversalClient
+	name    string
+	opts    LockOptions
+
+	sem    chan struct{} // 不可重入时的本地互斥, 持有锁或正在抢锁时占用
+	mu     sync.Mutex
+	locked bool          // 不可重入时本地是否持有锁
+	stop   chan struct{} // 关闭时停止看门狗
+}
+
+// NewRedisLock 创建分布式锁, name 为redis的key
+func NewRedisLock(rdb redis.UniversalClient, name string, opts ...LockOptionFunc) *RedisLock {
+	return NewRedlock([]redis.UniversalClient{rdb}, name, opts...)
+}
+
+// NewRedlock 在多个独立的redis上创建锁, 超过半数加锁成功才算成功
+// 多个redis之间不能是主从或集群关系, 否则和单个redis没有区别
+func NewRedlock(clients []redis.UniversalClient, name string, opts ...LockOptionFunc) *RedisLock {
+	o := LockOptions{
+		TTL:      defaultLockTTL,
+		Owner:    uuid.NewV4().String(),
+		RetryMin: defaultLockRetryMin,
+		RetryMax: defaultLockRetryMax,
+		Watchdog: true,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+	return &RedisLock{clients: clients, name: name, opts: o, sem: make(chan struct{}, 1)}
+}
+
+// Name 锁的key
+func (l *RedisLock) Name() string {
+	return l.name
+}
+
+// Owner 锁的持有者
+func (l *RedisLock) Owner() string {
+	return l.opts.Owner
+}
+
+// Lock 加锁, 锁被占用时退避重试, 直到成功或ctx结束
+func (l *RedisLock) Lock(ctx context.Context) error {
+	if !l.opts.Reentrant {
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return ErrLockNotAcquired
+		}
+	}
+	err := l.lock(ctx)
+	if err != nil && !l.opts.Reentrant {
+		<-l.sem
+	}
+	return err
+}
+
+func (l *RedisLock) lock(ctx context.Context) error {
+	backoff := l.opts.RetryMin
+	for {
+		ok, err := l.tryLock(ctx)
+		if ok {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return ErrLockNotAcquired
+			}
 			return err
 		}
+		// 加上随机时间, 避免多个副本同时重试
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ErrLockNotAcquired
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > l.opts.RetryMax {
+			backoff = l.opts.RetryMax
+		}
+	}
+}
+
+// TryLock 尝试加锁一次, 锁被占用时返回false
+func (l *RedisLock) TryLock(ctx context.Context) (bool, error) {
+	if !l.opts.Reentrant {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			return false, nil
+		}
+	}
+	ok, err := l.tryLock(ctx)
+	if !ok && !l.opts.Reentrant {
+		<-l.sem
+	}
+	return ok, err
+}
+
+func (l *RedisLock) tryLock(ctx context.Context) (bool, error) {
+	begin := time.Now()
+	n, failed, err := l.eval(ctx, lockScript)
+	if l.quorum(n) && time.Since(begin) < l.validity() {
+		l.acquired()
+		return true, nil
+	}
+	// 没有达到半数时释放已经加上的锁
+	if n > 0 {
+		_, _, _ = l.eval(context.Background(), unlockScript)
+	}
+	// 出错的redis太多, 不可能达到半数
+	if err != nil && !l.quorum(len(l.clients)-failed) {
+		return false, err
+	}
+	return false, nil
+}
+
+// Unlock 释放一次锁, 重入时需要释放相同的次数, 不是持有者或锁已经丢失时返回 ErrLockNotHeld
+func (l *RedisLock) Unlock(ctx context.Context) error {
+	// 释放和停止看门狗在锁内完成, 避免释放后立即重入的看门狗被停止
+	l.mu.Lock()
+	if !l.opts.Reentrant {
+		if !l.locked {
+			l.mu.Unlock()
+			return ErrLockNotHeld
+		}
+		l.locked = false
+		defer func() { <-l.sem }()
+	}
+	defer l.mu.Unlock()
+
+	var released int
+	var remaining int64
+	var err error
+	for _, c := range l.clients {
+		res, e := unlockScript.Run(ctx, c, []string{l.name}, l.opts.Owner, l.opts.TTL.Milliseconds()).Int64()
+		if e != nil {
+			err = e
+			continue
+		}
+		if res >= 0 {
+			released++
+		}
+		if res > remaining {
+			remaining = res
+		}
+	}
+	// 全部释放或已经不再持有时停止看门狗
+	if remaining == 0 && (released > 0 || err == nil) {
+		l.stopWatchdog()
+	}
+	if released > 0 {
 		return nil
 	}
+	if err != nil {
+		return err
+	}
+	return ErrLockNotHeld
+}
+
+// acquired 记录本地持有, 没有运行看门狗时启动
+func (l *RedisLock) acquired() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.opts.Reentrant {
+		l.locked = true
+	}
+	if l.stop == nil && l.opts.Watchdog {
+		l.stop = make(chan struct{})
+		go l.watchdog(l.stop)
+	}
+}
+
+func (l *RedisLock) stopWatchdog() {
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+}
 
+// watchdog 每 TTL/3 续期一次, 续期失败说明锁已经丢失, 停止续期, 之后再次加锁时重新启动
+func (l *RedisLock) watchdog(stop chan struct{}) {
+	ticker := time.NewTicker(l.opts.TTL / 3)
+	defer ticker.Stop()
 	for {
-		if err := redisConn.Watch(context.Background(), txf, lockName); err == nil {
-			return true
-		} else if err == redis.TxFailedErr {
-			fmt.Println("watch key is modified, retry to release lock. err:", err.Error())
-		} else {
-			fmt.Println("err:", err.Error())
-			return false
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(WithQuietLog(context.Background()), l.opts.TTL/3)
+		n, _, err := l.eval(ctx, renewScript)
+		cancel()
+		if !l.quorum(n) {
+			log.Printf("[redis_lock] %s renew failed, lock lost, err: %v", l.name, err)
+			l.mu.Lock()
+			if l.stop == stop {
+				l.stop = nil
+			}
+			l.mu.Unlock()
+			return
+		}
+	}
+}
+
+// eval 在所有redis上执行脚本, 返回结果为1的数量、出错的数量和最后一个错误
+func (l *RedisLock) eval(ctx context.Context, script *redis.Script) (n, failed int, err error) {
+	for _, c := range l.clients {
+		res, e := script.Run(ctx, c, []string{l.name}, l.opts.Owner, l.opts.TTL.Milliseconds()).Int64()
+		if e != nil {
+			failed++
+			err = e
+			continue
+		}
+		if res == 1 {
+			n++
 		}
 	}
+	return
+}
+
+func (l *RedisLock) quorum(n int) bool {
+	return n >= len(l.clients)/2+1
+}
+
+// validity 锁的有效时间, 多个redis时扣除时钟漂移
+func (l *RedisLock) validity() time.Duration {
+	if len(l.clients) == 1 {
+		return l.opts.TTL
+	}
+	drift := time.Duration(float64(l.opts.TTL)*lockClockDriftRate) + 2*time.Millisecond
+	return l.opts.TTL - drift
+}
+
+// GetLock acquireTimeout Get the lock timeout period, If no lock is obtained within this period, err will be returned here
+// lockTimeOut Lock timeout to prevent deadlock, lock automatically unlocked by this time
+//
+// Deprecated: use NewRedisLock, the lock returned here is not renewed.
+// Upgrade note: the lock is now a hash instead of the string written by SET NX in older versions.
+// Old versions see a hash lock as held and new versions see a string lock as held, so both stay mutually
+// exclusive during a rolling deploy. Do not roll back while a code from the new GetLock may still be released:
+// ReleaseLock in older versions cannot delete a hash lock, which is then only freed after lockTimeOut.
+func GetLock(redisConn redis.UniversalClient, lockName string, acquireTimeout, lockTimeOut time.Duration) (string, error) {
+	l := NewRedisLock(redisConn, lockName, WithLockTTL(lockTimeOut), WithoutWatchdog())
+	ctx, cancel := context.WithTimeout(context.Background(), acquireTimeout)
+	defer cancel()
+	if err := l.Lock(ctx); err != nil {
+		return "", err
+	}
+	return l.Owner(), nil
+}
+
+// ReleaseLock release the lock acquired by GetLock, code is the value returned by GetLock
+//
+// Deprecated: use RedisLock.Unlock. It also releases a string lock written by older versions of GetLock.
+func ReleaseLock(redisConn redis.UniversalClient, lockName, code string) bool {
+	l := NewRedisLock(redisConn, lockName, WithLockOwner(code), WithoutWatchdog())
+	return l.Unlock(context.Background()) == nil
 }